@@ -0,0 +1,150 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/mguentner/passwordless/state"
+	"github.com/rs/zerolog/log"
+)
+
+type EventType string
+
+const (
+	TokenRequested EventType = "tokenRequested"
+	// The request was rejected by the domain or registration policy
+	TokenRejected  EventType = "tokenRejected"
+	TokenDelivered EventType = "tokenDelivered"
+	DeliveryFailed EventType = "deliveryFailed"
+	AuthSuccess    EventType = "authSuccess"
+	AuthFailure    EventType = "authFailure"
+	Refresh        EventType = "refresh"
+	Revocation     EventType = "revocation"
+	// The identifier reached maxLoginTokenCount
+	Lockout EventType = "lockout"
+)
+
+// An Event never contains the identifier itself, only the hash used as key
+// in the state database
+type Event struct {
+	ID             string    `json:"id"`
+	Type           EventType `json:"type"`
+	Time           time.Time `json:"time"`
+	IdentifierHash string    `json:"identifierHash,omitempty"`
+	IP             string    `json:"ip,omitempty"`
+	UserAgent      string    `json:"userAgent,omitempty"`
+	RequestID      string    `json:"requestID,omitempty"`
+	// Reason of failures
+	Detail string `json:"detail,omitempty"`
+}
+
+// Source describes the request that caused an event
+type Source struct {
+	IP        string
+	UserAgent string
+	RequestID string
+}
+
+// NewEvent returns an event for the identifier, id may be empty if the
+// request did not carry a valid identifier
+func NewEvent(eventType EventType, id string, source Source) Event {
+	event := Event{
+		Type:      eventType,
+		IP:        source.IP,
+		UserAgent: source.UserAgent,
+		RequestID: source.RequestID,
+	}
+	if len(id) > 0 {
+		event.IdentifierHash = state.EncodeIdentifier(id)
+	}
+	return event
+}
+
+// WithDetail returns a copy of the event carrying the error as reason
+func (e Event) WithDetail(err error) Event {
+	if err != nil {
+		e.Detail = err.Error()
+	}
+	return e
+}
+
+type Sink interface {
+	Write(event Event) error
+}
+
+// A ClosingSink has to flush buffered events before shutdown
+type ClosingSink interface {
+	Sink
+	Close(ctx context.Context) error
+}
+
+// Logger passes events to all of its sinks
+type Logger struct {
+	mutex sync.RWMutex
+	sinks []Sink
+}
+
+var DefaultLogger = &Logger{}
+
+func (l *Logger) SetSinks(sinks []Sink) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sinks = sinks
+}
+
+func newEventID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// Emit sets ID and Time if missing and writes the event to every sink,
+// failing sinks are logged but never fail the caller
+func (l *Logger) Emit(event Event) {
+	if len(event.ID) == 0 {
+		event.ID = newEventID()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for _, sink := range l.sinks {
+		err := sink.Write(event)
+		if err != nil {
+			log.Error().Str("module", "audit").Msgf("Could not write %s event: %v", event.Type, err)
+		}
+	}
+}
+
+// Close flushes and closes the sinks, events emitted afterwards are
+// dropped. Returns the first error.
+func (l *Logger) Close(ctx context.Context) error {
+	l.mutex.Lock()
+	sinks := l.sinks
+	l.sinks = nil
+	l.mutex.Unlock()
+	var result error
+	for _, sink := range sinks {
+		closingSink, ok := sink.(ClosingSink)
+		if !ok {
+			continue
+		}
+		err := closingSink.Close(ctx)
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Emit writes the event using the DefaultLogger
+func Emit(event Event) {
+	DefaultLogger.Emit(event)
+}
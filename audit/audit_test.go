@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestWriterSink(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger := &Logger{}
+	logger.SetSinks([]Sink{NewWriterSink(buffer)})
+	logger.Emit(NewEvent(AuthFailure, "foo@bar.com", Source{IP: "10.0.0.1", RequestID: "abc"}).WithDetail(errors.New("NoSuchIdentifierTokenPair")))
+	logger.Emit(NewEvent(AuthSuccess, "foo@bar.com", Source{}))
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+	event := Event{}
+	err := json.Unmarshal([]byte(lines[0]), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != AuthFailure || event.IP != "10.0.0.1" || event.RequestID != "abc" || event.Detail != "NoSuchIdentifierTokenPair" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if len(event.ID) == 0 || event.Time.IsZero() {
+		t.Error("Expected ID and Time to be set")
+	}
+	if event.IdentifierHash != state.EncodeIdentifier("foo@bar.com") {
+		t.Error("Expected the identifier to be hashed")
+	}
+	if strings.Contains(buffer.String(), "foo@bar.com") {
+		t.Error("Expected the identifier not to be logged")
+	}
+}
+
+func TestStateSinkQuery(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := &state.State{
+		DB: db,
+	}
+	logger := &Logger{}
+	logger.SetSinks([]Sink{StateSink{State: s, Retention: time.Hour}})
+	start := time.Now()
+	old := NewEvent(TokenRequested, "foo@bar.com", Source{})
+	old.Time = start.Add(-time.Minute)
+	logger.Emit(old)
+	logger.Emit(NewEvent(TokenRequested, "foo@bar.com", Source{}))
+	logger.Emit(NewEvent(TokenDelivered, "foo@bar.com", Source{}))
+	logger.Emit(NewEvent(TokenRequested, "other@bar.com", Source{}))
+
+	events, err := Query(s, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got %d", len(events))
+	}
+	if events[0].IdentifierHash != state.EncodeIdentifier("other@bar.com") {
+		t.Error("Expected the newest event first")
+	}
+	events, err = Query(s, Filter{Since: start, Type: TokenRequested, IdentifierHash: state.EncodeIdentifier("foo@bar.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("Expected 1 filtered event, got %d", len(events))
+	}
+	events, err = Query(s, Filter{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("Expected 2 events, got %d", len(events))
+	}
+}
+
+func TestLoggerCloseDrainsWebhookSink(t *testing.T) {
+	received := make(chan Event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Slow receiver, events are still queued when Close is called
+		time.Sleep(20 * time.Millisecond)
+		event := Event{}
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer server.Close()
+	logger := &Logger{}
+	logger.SetSinks([]Sink{NewWebhookSink(config.WebhookConfig{URL: server.URL}, 10)})
+	for i := 0; i < 3; i++ {
+		logger.Emit(NewEvent(TokenRequested, "foo@bar.com", Source{}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := logger.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 3 {
+		t.Errorf("Expected 3 events to be posted before Close returned, got %d", len(received))
+	}
+	// Events after Close are dropped instead of panicking on the closed queue
+	logger.Emit(NewEvent(TokenRequested, "foo@bar.com", Source{}))
+}
@@ -0,0 +1,191 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/deliver"
+	"github.com/mguentner/passwordless/state"
+	"github.com/rs/zerolog/log"
+)
+
+// WriterSink writes events as JSON lines
+type WriterSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	// Only set for files opened by NewFileSink
+	file *os.File
+}
+
+func NewWriterSink(writer io.Writer) *WriterSink {
+	return &WriterSink{writer: writer}
+}
+
+// NewFileSink appends events to the file at path, creating it if necessary
+func NewFileSink(path string) (*WriterSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterSink{writer: file, file: file}, nil
+}
+
+func (s *WriterSink) Close(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *WriterSink) Write(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.writer.Write(append(line, '\n'))
+	return err
+}
+
+// WebhookSink posts every event to an HTTP endpoint. Events are sent in
+// the background so a slow receiver does not delay logins, events are
+// dropped if the queue is full.
+type WebhookSink struct {
+	config config.WebhookConfig
+	queue  chan Event
+	done   chan struct{}
+}
+
+func NewWebhookSink(webhookConfig config.WebhookConfig, queueSize int) *WebhookSink {
+	sink := &WebhookSink{
+		config: webhookConfig,
+		queue:  make(chan Event, queueSize),
+		done:   make(chan struct{}),
+	}
+	go sink.run()
+	return sink
+}
+
+func (s *WebhookSink) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Error().Str("module", "audit").Msgf("Could not marshal event: %v", err)
+			continue
+		}
+		err = deliver.PostWebhook(s.config, time.Now().Unix(), body)
+		if err != nil {
+			log.Error().Str("module", "audit").Msgf("Could not post %s event: %v", event.Type, err)
+		}
+	}
+}
+
+type QueueFull struct{}
+
+func (e *QueueFull) Error() string {
+	return "QueueFull"
+}
+
+// Close waits until the queued events are posted or ctx is done, Write
+// must not be called afterwards
+func (s *WebhookSink) Close(ctx context.Context) error {
+	close(s.queue)
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *WebhookSink) Write(event Event) error {
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		return &QueueFull{}
+	}
+}
+
+// StateSink stores events in the state database, see Query
+type StateSink struct {
+	State     *state.State
+	Retention time.Duration
+}
+
+func (s StateSink) Write(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.State.InsertAuditEvent(event.Time, data, s.Retention)
+}
+
+// Filter restricts the events returned by Query, empty fields match
+// everything
+type Filter struct {
+	Since          time.Time
+	Type           EventType
+	IdentifierHash string
+	Limit          int
+}
+
+// Query returns the events stored by a StateSink, newest first. The
+// iteration stops as soon as the limit is reached.
+func Query(s *state.State, filter Filter) ([]Event, error) {
+	events := []Event{}
+	err := s.EachAuditEvent(filter.Since, func(data []byte) (bool, error) {
+		event := Event{}
+		err := json.Unmarshal(data, &event)
+		if err != nil {
+			return false, err
+		}
+		if len(filter.Type) > 0 && event.Type != filter.Type {
+			return true, nil
+		}
+		if len(filter.IdentifierHash) > 0 && event.IdentifierHash != filter.IdentifierHash {
+			return true, nil
+		}
+		events = append(events, event)
+		return filter.Limit <= 0 || len(events) < filter.Limit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// SinksFromConfig creates the sinks enabled in the audit configuration
+func SinksFromConfig(auditConfig config.AuditConfig, s *state.State) ([]Sink, error) {
+	sinks := []Sink{}
+	if len(auditConfig.FilePath) > 0 {
+		fileSink, err := NewFileSink(auditConfig.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, fileSink)
+	}
+	if auditConfig.Stdout {
+		sinks = append(sinks, NewWriterSink(os.Stdout))
+	}
+	if auditConfig.Webhook.Enabled() {
+		sinks = append(sinks, NewWebhookSink(auditConfig.Webhook, 1000))
+	}
+	if auditConfig.RetentionSeconds > 0 {
+		sinks = append(sinks, StateSink{State: s, Retention: auditConfig.Retention()})
+	}
+	return sinks, nil
+}
@@ -0,0 +1,235 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/identifier"
+	"github.com/mguentner/passwordless/state"
+	"github.com/rs/zerolog"
+	flag "github.com/spf13/pflag"
+)
+
+func stateUsage(w io.Writer) {
+	fmt.Fprintln(w, "USAGE passwordless state COMMAND [FLAGS]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  dump    list keys grouped by record type")
+	fmt.Fprintln(w, "  tokens  count live login tokens per identifier")
+	fmt.Fprintln(w, "  purge   remove all records of --identifier")
+	fmt.Fprintln(w, "  gc      compact the database and run the value log GC")
+	fmt.Fprintln(w, "  stats   print database size statistics")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Opens statePath of the config, the service must not be running.")
+}
+
+var stateCommands = map[string]func(s *state.State, c config.Config, o stateOptions) (interface{}, error){
+	"dump":   stateDump,
+	"tokens": stateTokens,
+	"purge":  statePurge,
+	"gc":     stateGC,
+	"stats":  stateStats,
+}
+
+type stateOptions struct {
+	identifier   string
+	discardRatio float64
+	stdout       io.Writer
+	human        bool
+}
+
+// State implements `passwordless state`, it returns the exit code
+func State(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		stateUsage(stderr)
+		return 2
+	}
+	command, ok := stateCommands[args[0]]
+	if !ok {
+		stateUsage(stderr)
+		return 2
+	}
+	flags := flag.NewFlagSet("state "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("configPath", "config.yaml", "path to the config file")
+	id := flags.String("identifier", "", "identifier for purge, filters tokens")
+	discardRatio := flags.Float64("discardRatio", 0.5, "rewrite value log files with at least this ratio of stale data")
+	asJSON := flags.Bool("json", false, "print JSON")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
+	appConfig, err := config.ReadConfigFromFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not read config: %v\n", err)
+		return 2
+	}
+	options := stateOptions{
+		discardRatio: *discardRatio,
+		stdout:       stdout,
+		human:        !*asJSON,
+	}
+	if len(*id) > 0 {
+		options.identifier, err = identifier.Canonicalize(appConfig.Identifiers, *id)
+		if err != nil {
+			fmt.Fprintf(stderr, "Invalid identifier: %v\n", err)
+			return 2
+		}
+	}
+	// badger is chatty when opening and closing the database
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	s, err := state.NewState(*appConfig, nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not open state: %v\n", err)
+		return 2
+	}
+	defer s.DB.Close()
+	result, err := command(s, *appConfig, options)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	if options.human {
+		return 0
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(result)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not marshal: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+func formatTimestamp(timestamp int64) string {
+	if timestamp == 0 {
+		return "never"
+	}
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+func stateDump(s *state.State, c config.Config, o stateOptions) (interface{}, error) {
+	groups, err := s.KeysByType()
+	if err != nil {
+		return nil, err
+	}
+	if o.human {
+		recordTypes := []string{}
+		for recordType := range groups {
+			recordTypes = append(recordTypes, recordType)
+		}
+		sort.Strings(recordTypes)
+		for _, recordType := range recordTypes {
+			fmt.Fprintf(o.stdout, "===== %s (%d) =====\n", recordType, len(groups[recordType]))
+			for _, key := range groups[recordType] {
+				fmt.Fprintf(o.stdout, "%s\texpires %s\t%d bytes\n", key.Key, formatTimestamp(key.ExpiresAt), key.Size)
+			}
+		}
+	}
+	return groups, nil
+}
+
+func stateTokens(s *state.State, c config.Config, o stateOptions) (interface{}, error) {
+	counts, err := s.TokenCounts()
+	if err != nil {
+		return nil, err
+	}
+	if len(o.identifier) > 0 {
+		encoded := state.EncodeIdentifier(o.identifier)
+		filtered := []state.TokenCount{}
+		for _, count := range counts {
+			if count.EncodedIdentifier == encoded {
+				filtered = append(filtered, count)
+			}
+		}
+		counts = filtered
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Count > counts[j].Count
+	})
+	if o.human {
+		for _, count := range counts {
+			id := count.Identifier
+			if len(id) == 0 {
+				id = "(no user)"
+			}
+			limited := ""
+			if count.Count >= int(c.MaxLoginTokenCount) {
+				limited = "\tlimited"
+			}
+			fmt.Fprintf(o.stdout, "%s\t%s\t%d%s\n", count.EncodedIdentifier, id, count.Count, limited)
+		}
+	}
+	return counts, nil
+}
+
+type purgeResult struct {
+	Identifier string `json:"identifier"`
+	Deleted    int    `json:"deleted"`
+}
+
+func statePurge(s *state.State, c config.Config, o stateOptions) (interface{}, error) {
+	if len(o.identifier) == 0 {
+		return nil, fmt.Errorf("purge requires --identifier")
+	}
+	deleted, err := s.PurgeIdentifier(o.identifier)
+	if err != nil {
+		return nil, err
+	}
+	if o.human {
+		fmt.Fprintf(o.stdout, "Removed %d keys of %s\n", deleted, o.identifier)
+	}
+	return purgeResult{Identifier: o.identifier, Deleted: deleted}, nil
+}
+
+type gcResult struct {
+	Before    state.Stats `json:"before"`
+	After     state.Stats `json:"after"`
+	Rewritten int         `json:"rewritten"`
+}
+
+func stateGC(s *state.State, c config.Config, o stateOptions) (interface{}, error) {
+	before, err := s.Stats()
+	if err != nil {
+		return nil, err
+	}
+	rewritten, err := s.Compact(o.discardRatio)
+	if err != nil {
+		return nil, err
+	}
+	after, err := s.Stats()
+	if err != nil {
+		return nil, err
+	}
+	if o.human {
+		fmt.Fprintf(o.stdout, "Rewrote %d value log files\n", rewritten)
+		fmt.Fprintf(o.stdout, "LSM:       %d -> %d bytes\n", before.LSMSize, after.LSMSize)
+		fmt.Fprintf(o.stdout, "Value log: %d -> %d bytes\n", before.VLogSize, after.VLogSize)
+	}
+	return gcResult{Before: *before, After: *after, Rewritten: rewritten}, nil
+}
+
+func stateStats(s *state.State, c config.Config, o stateOptions) (interface{}, error) {
+	stats, err := s.Stats()
+	if err != nil {
+		return nil, err
+	}
+	if o.human {
+		fmt.Fprintf(o.stdout, "LSM:       %d bytes\n", stats.LSMSize)
+		fmt.Fprintf(o.stdout, "Value log: %d bytes\n", stats.VLogSize)
+		recordTypes := []string{}
+		for recordType := range stats.Keys {
+			recordTypes = append(recordTypes, recordType)
+		}
+		sort.Strings(recordTypes)
+		for _, recordType := range recordTypes {
+			fmt.Fprintf(o.stdout, "%-11s%d keys\n", recordType+":", stats.Keys[recordType])
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/template"
+	flag "github.com/spf13/pflag"
+)
+
+func templatesUsage(w io.Writer) {
+	fmt.Fprintln(w, "USAGE passwordless templates COMMAND [FLAGS]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  render  render templates with sample data and report problems")
+	fmt.Fprintln(w, "  lint    only report problems")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Exits with 1 if problems were found.")
+}
+
+type renderOutput struct {
+	Rendered []template.Rendered `json:"rendered,omitempty"`
+	Problems []template.Problem  `json:"problems"`
+}
+
+// Templates implements `passwordless templates`, it returns the exit code
+func Templates(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || !(args[0] == "render" || args[0] == "lint") {
+		templatesUsage(stderr)
+		return 2
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("templates "+command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	lang := flags.String("lang", "", "only this language")
+	id := flags.String("id", "", "only this template id, e.g. email")
+	path := flags.String("path", "", "template directory, overrides templates.path of the config")
+	configPath := flags.String("configPath", "", "read templates.path from this config file")
+	asJSON := flags.Bool("json", false, "print JSON")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
+	templatePath := *path
+	if len(templatePath) == 0 && len(*configPath) > 0 {
+		appConfig, err := config.ReadConfigFromFile(*configPath)
+		if err != nil {
+			fmt.Fprintf(stderr, "Could not read config: %v\n", err)
+			return 2
+		}
+		templatePath = appConfig.Templates.Path
+	}
+	rendered, problems, err := template.Render(templatePath, *lang, *id)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not read templates: %v\n", err)
+		return 2
+	}
+	if command == "lint" {
+		rendered = nil
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(renderOutput{Rendered: rendered, Problems: problems})
+		if err != nil {
+			fmt.Fprintf(stderr, "Could not marshal: %v\n", err)
+			return 2
+		}
+	} else {
+		for _, r := range rendered {
+			fmt.Fprintf(stdout, "===== %s/%s =====\n%s\n", r.Lang, r.ID, r.Output)
+		}
+		for _, problem := range problems {
+			fmt.Fprintf(stderr, "PROBLEM %s\n", problem)
+		}
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Run dispatches subcommands, ok is false if args do not start with a known
+// subcommand
+func Run(args []string) (code int, ok bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "templates":
+		return Templates(args[1:], os.Stdout, os.Stderr), true
+	case "state":
+		return State(args[1:], os.Stdout, os.Stderr), true
+	}
+	return 0, false
+}
@@ -2,21 +2,462 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+type DKIMConfig struct {
+	// The signing domain (d=), usually the domain of fromAddr
+	Domain string `yaml:"domain"`
+	// The selector (s=), the public key is expected under
+	// <selector>._domainkey.<domain>
+	Selector string `yaml:"selector"`
+	// PEM encoded RSA or Ed25519 private key, signing is disabled
+	// if this is empty
+	PrivateKeyPath string `yaml:"privateKeyPath"`
+}
+
+func (c DKIMConfig) Enabled() bool {
+	return len(c.PrivateKeyPath) > 0
+}
+
+func (c DKIMConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if len(c.Domain) == 0 {
+		return errors.New("dkim.domain needs to be filled")
+	}
+	if len(c.Selector) == 0 {
+		return errors.New("dkim.selector needs to be filled")
+	}
+	return nil
+}
+
 type SMTPConfig struct {
 	FromAddr string `yaml:"fromAddr"`
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
 	Host     string `yaml:"host"`
 	Port     uint16 `yaml:"port"`
+	// See DKIMConfig, optional
+	DKIM DKIMConfig `yaml:"dkim"`
+}
+
+type SMSConfig struct {
+	// HTTP endpoint of the SMS gateway, SMS delivery is disabled if
+	// this is empty
+	GatewayURL string `yaml:"gatewayURL"`
+	// Defaults to POST
+	Method string `yaml:"method"`
+	// Defaults to application/json
+	ContentType string `yaml:"contentType"`
+	// text/template for the request body. Available fields are
+	// .From, .To and .Body, use the `json` or `urlquery` functions for
+	// escaping. Defaults to a JSON object with `from`, `to` and `text`
+	BodyTemplate string `yaml:"bodyTemplate"`
+	// Additional request headers, e.g. an API key
+	Headers map[string]string `yaml:"headers"`
+	// Optional HTTP basic auth
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// Sender ID or number
+	From string `yaml:"from"`
+	// Defaults to 10 seconds
+	TimeoutSeconds uint64 `yaml:"timeoutSeconds"`
+}
+
+func (c SMSConfig) Enabled() bool {
+	return len(c.GatewayURL) > 0
+}
+
+type WebhookConfig struct {
+	// Endpoint that receives the rendered messages as JSON, webhook
+	// delivery is disabled if this is empty
+	URL string `yaml:"url"`
+	// Shared secret used to sign the payload with HMAC-SHA256, the
+	// signature is sent in the X-Passwordless-Signature header
+	Secret string `yaml:"secret"`
+	// Timeout of a single attempt, defaults to 10 seconds
+	TimeoutSeconds uint64 `yaml:"timeoutSeconds"`
+	// How often a failed delivery (network error, 429 or 5xx) is
+	// retried
+	MaxRetries uint8 `yaml:"maxRetries"`
+	// Delay before the first retry, doubled for each subsequent retry.
+	// Defaults to 500ms
+	RetryBackoffMilliseconds uint64 `yaml:"retryBackoffMilliseconds"`
+}
+
+func (c WebhookConfig) Enabled() bool {
+	return len(c.URL) > 0
+}
+
+// Settings for the development agents `log`, `file` and `outbox`. Never
+// use these in production, all of them expose login tokens.
+type DevConfig struct {
+	// Directory the `file` agent writes messages to, using the maildir
+	// layout (tmp/, new/, cur/)
+	FileDeliveryPath string `yaml:"fileDeliveryPath"`
+	// How many messages the `outbox` agent keeps, defaults to 100
+	OutboxSize int `yaml:"outboxSize"`
+	// Serve the outbox under /dev/outbox
+	OutboxEndpoint bool `yaml:"outboxEndpoint"`
+}
+
+// A RouteConfig selects the agent for identifiers matching all of the
+// set criteria, a route without criteria matches every identifier.
+type RouteConfig struct {
+	// Either `email` or `phone`
+	Kind string `yaml:"kind"`
+	// Domain of an e-mail address, `*.example.com` matches all
+	// subdomains of example.com
+	Domain string `yaml:"domain"`
+	// Regular expression matched against the identifier
+	Pattern string `yaml:"pattern"`
+	// Name of a registered agent. Built in are smtp, sms, webhook,
+	// log, file and outbox
+	Agent string `yaml:"agent"`
+	// Agents that are tried in order if the delivery through Agent
+	// fails
+	Fallbacks []string `yaml:"fallbacks"`
+}
+
+func (c RouteConfig) Validate() error {
+	if len(c.Agent) == 0 {
+		return errors.New("Every route needs an agent")
+	}
+	if !(c.Kind == "" || c.Kind == "email" || c.Kind == "phone") {
+		return fmt.Errorf("Route kind %q not `email` or `phone`", c.Kind)
+	}
+	_, err := regexp.Compile(c.Pattern)
+	if err != nil {
+		return fmt.Errorf("Invalid route pattern %q: %v", c.Pattern, err)
+	}
+	return nil
+}
+
+type TemplatesConfig struct {
+	// Directory with <lang>/<id>.tmpl files overriding or extending the
+	// built in templates (email, email-subject, email-html and sms).
+	// Only the built in templates are used if this is empty
+	Path string `yaml:"path"`
+	// Check for changed templates in this interval, 0 disables reloading
+	ReloadIntervalSeconds uint64 `yaml:"reloadIntervalSeconds"`
+	// IANA time zone used for times in messages, defaults to UTC
+	TimeZone string `yaml:"timeZone"`
+}
+
+func (c TemplatesConfig) Location() (*time.Location, error) {
+	if len(c.TimeZone) == 0 {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(c.TimeZone)
+}
+
+type AdminConfig struct {
+	// Bearer token for the /admin routes, they are disabled if this is
+	// empty. Use a long random string
+	Token string `yaml:"token"`
+}
+
+func (c AdminConfig) Enabled() bool {
+	return len(c.Token) > 0
+}
+
+// PolicyConfig restricts which e-mail addresses can request login tokens,
+// domains support `*.example.com` for all subdomains
+type PolicyConfig struct {
+	// If this or allowedAddresses is set, only matching addresses are
+	// accepted
+	AllowedDomains []string `yaml:"allowedDomains"`
+	// Always rejected, even if they match allowedDomains
+	BlockedDomains []string `yaml:"blockedDomains"`
+	// Accepted regardless of the other settings
+	AllowedAddresses []string `yaml:"allowedAddresses"`
+	// Optional file with one disposable domain per line, lines starting
+	// with # are ignored. Subdomains are rejected as well
+	DisposableDomainsPath string `yaml:"disposableDomainsPath"`
+}
+
+// IdentifierConfig controls how identifiers are canonicalized before they
+// are stored, compared or put into tokens. Display names are always
+// stripped and domains are lower-cased and converted to punycode. Messages
+// are sent to the address as entered, only with these two steps applied.
+type IdentifierConfig struct {
+	// Lower-case the local part (before the @). Most providers ignore its
+	// case but RFC 5321 allows mailboxes to be case sensitive, so it is
+	// kept by default
+	LowercaseLocalPart bool `yaml:"lowercaseLocalPart"`
+	// Apply rules of well known providers, e.g. for gmail.com dots and
+	// +tags are removed and googlemail.com is mapped to gmail.com
+	ProviderRules bool `yaml:"providerRules"`
+	// Remove +tags for these domains, `*` applies to all domains
+	PlusAddressingDomains []string `yaml:"plusAddressingDomains"`
+}
+
+// AuditConfig selects the sinks authentication events are written to,
+// auditing is disabled if no sink is configured
+type AuditConfig struct {
+	// Append events as JSON lines to this file
+	FilePath string `yaml:"filePath"`
+	// Write events as JSON lines to stdout
+	Stdout bool `yaml:"stdout"`
+	// POST every event to an HTTP endpoint, signed like webhook deliveries
+	Webhook WebhookConfig `yaml:"webhook"`
+	// Keep events in the state database for this long so they can be
+	// queried via /admin/audit, 0 disables storing them
+	RetentionSeconds uint64 `yaml:"retentionSeconds"`
+}
+
+func (c AuditConfig) Retention() time.Duration {
+	return time.Second * time.Duration(c.RetentionSeconds)
+}
+
+// MetricsConfig enables the Prometheus endpoint under /metrics
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Optional bearer token scrapers have to send
+	Token string `yaml:"token"`
+}
+
+// TracingConfig configures OpenTelemetry tracing, incoming `traceparent`
+// headers are honored
+type TracingConfig struct {
+	// `otlp` (OTLP over HTTP), `stdout` or empty to disable tracing
+	Exporter string `yaml:"exporter"`
+	// host:port of the OTLP collector, defaults to localhost:4318
+	Endpoint string `yaml:"endpoint"`
+	// Use HTTP instead of HTTPS to talk to the collector
+	Insecure bool `yaml:"insecure"`
+	// Fraction of new traces that are sampled, defaults to 1. 0 only
+	// samples requests whose parent span is sampled
+	SampleRatio *float64 `yaml:"sampleRatio"`
+}
+
+func (c TracingConfig) Enabled() bool {
+	return len(c.Exporter) > 0
+}
+
+func (c TracingConfig) GetEndpoint() string {
+	if len(c.Endpoint) == 0 {
+		return "localhost:4318"
+	}
+	return c.Endpoint
+}
+
+func (c TracingConfig) GetSampleRatio() float64 {
+	if c.SampleRatio == nil {
+		return 1
+	}
+	return *c.SampleRatio
+}
+
+// ReadinessConfig controls the checks of /ready, the state database and
+// the signing keys are always checked
+type ReadinessConfig struct {
+	// Also connect to the delivery agents in use, e.g. the SMTP server
+	ProbeDelivery bool `yaml:"probeDelivery"`
+	// How long the result of the delivery probe is reused, so that
+	// frequent polling does not open a connection each time. Defaults
+	// to 30 seconds
+	ProbeDeliveryIntervalSeconds uint64 `yaml:"probeDeliveryIntervalSeconds"`
+	// Checks that take longer fail, defaults to 5 seconds
+	TimeoutSeconds uint64 `yaml:"timeoutSeconds"`
+}
+
+func (c ReadinessConfig) ProbeDeliveryInterval() time.Duration {
+	if c.ProbeDeliveryIntervalSeconds == 0 {
+		return 30 * time.Second
+	}
+	return time.Second * time.Duration(c.ProbeDeliveryIntervalSeconds)
+}
+
+func (c ReadinessConfig) Timeout() time.Duration {
+	if c.TimeoutSeconds == 0 {
+		return 5 * time.Second
+	}
+	return time.Second * time.Duration(c.TimeoutSeconds)
+}
+
+// TLSConfig lets the server terminate TLS itself. Certificate and key are
+// PEM files and reloaded when they change, so they can be renewed without
+// a restart.
+type TLSConfig struct {
+	CertPath string `yaml:"certPath"`
+	KeyPath  string `yaml:"keyPath"`
+	// Optional PEM bundle of CAs, if set the /admin routes require a
+	// client certificate signed by one of them in addition to the token.
+	// Certificates of other CAs are rejected on all routes
+	ClientCAPath string `yaml:"clientCAPath"`
+	// How often the files are checked for changes, defaults to 60
+	ReloadIntervalSeconds uint64 `yaml:"reloadIntervalSeconds"`
+}
+
+func (c TLSConfig) Enabled() bool {
+	return len(c.CertPath) > 0
+}
+
+func (c TLSConfig) ReloadInterval() time.Duration {
+	return secondsOrDefault(c.ReloadIntervalSeconds, 60*time.Second)
+}
+
+func (c TLSConfig) Validate() error {
+	if len(c.CertPath) > 0 && len(c.KeyPath) == 0 || len(c.CertPath) == 0 && len(c.KeyPath) > 0 {
+		return errors.New("tls.certPath and tls.keyPath must be set together")
+	}
+	if len(c.ClientCAPath) > 0 && !c.Enabled() {
+		return errors.New("tls.clientCAPath requires tls.certPath and tls.keyPath")
+	}
+	return nil
+}
+
+// CORSPolicy controls which browser origins may call a group of routes,
+// cross-origin requests are refused if allowedOrigins is empty
+type CORSPolicy struct {
+	// Exact origins like `https://app.example.com`, `https://*.example.com`
+	// for all subdomains or `*` for any origin
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+	// Allow cookies and client certificates, not possible with `*`
+	AllowCredentials bool `yaml:"allowCredentials"`
+	// Request headers the browser may send, defaults to Authorization,
+	// Content-Type and X-Request-ID
+	AllowedHeaders []string `yaml:"allowedHeaders"`
+	// How long browsers may cache preflight responses, 0 leaves it to the
+	// browser
+	MaxAgeSeconds int `yaml:"maxAgeSeconds"`
+}
+
+func (c CORSPolicy) GetAllowedHeaders() []string {
+	if len(c.AllowedHeaders) == 0 {
+		return []string{"Authorization", "Content-Type", "X-Request-ID"}
+	}
+	return c.AllowedHeaders
+}
+
+func (c CORSPolicy) Validate(name string) error {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" && c.AllowCredentials {
+			return fmt.Errorf("cors.%s.allowCredentials cannot be used with the origin `*`", name)
+		}
+		if strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("cors.%s.allowedOrigins: only one `*` per origin allowed in %q", name, origin)
+		}
+	}
+	if c.MaxAgeSeconds < 0 {
+		return fmt.Errorf("cors.%s.maxAgeSeconds must not be negative", name)
+	}
+	return nil
+}
+
+// CORSConfig has separate policies for /admin and all other routes
+type CORSConfig struct {
+	API   CORSPolicy `yaml:"api"`
+	Admin CORSPolicy `yaml:"admin"`
+}
+
+// ServerConfig sets the timeouts of the HTTP server
+type ServerConfig struct {
+	// Maximum time to read a request including its body, defaults to 10
+	ReadTimeoutSeconds uint64 `yaml:"readTimeoutSeconds"`
+	// Maximum time to write a response, defaults to 30
+	WriteTimeoutSeconds uint64 `yaml:"writeTimeoutSeconds"`
+	// How long idle keep-alive connections stay open, defaults to 120
+	IdleTimeoutSeconds uint64 `yaml:"idleTimeoutSeconds"`
+	// How long to wait for in-flight requests and pending deliveries on
+	// SIGINT or SIGTERM, defaults to 30
+	ShutdownTimeoutSeconds uint64 `yaml:"shutdownTimeoutSeconds"`
+}
+
+func secondsOrDefault(seconds uint64, fallback time.Duration) time.Duration {
+	if seconds == 0 {
+		return fallback
+	}
+	return time.Second * time.Duration(seconds)
+}
+
+func (c ServerConfig) ReadTimeout() time.Duration {
+	return secondsOrDefault(c.ReadTimeoutSeconds, 10*time.Second)
+}
+
+func (c ServerConfig) WriteTimeout() time.Duration {
+	return secondsOrDefault(c.WriteTimeoutSeconds, 30*time.Second)
+}
+
+func (c ServerConfig) IdleTimeout() time.Duration {
+	return secondsOrDefault(c.IdleTimeoutSeconds, 120*time.Second)
+}
+
+func (c ServerConfig) ShutdownTimeout() time.Duration {
+	return secondsOrDefault(c.ShutdownTimeoutSeconds, 30*time.Second)
+}
+
+// UniformResponseConfig hides whether a login request succeeded. With it
+// enabled /api/login always answers with an empty 200 response after
+// the same delay, failures are only logged.
+type UniformResponseConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Should be longer than the slowest delivery, defaults to 1000ms
+	DelayMilliseconds uint64 `yaml:"delayMilliseconds"`
+}
+
+func (c UniformResponseConfig) Delay() time.Duration {
+	if c.DelayMilliseconds == 0 {
+		return time.Second
+	}
+	return time.Millisecond * time.Duration(c.DelayMilliseconds)
+}
+
+// RegistrationConfig controls who can log in for the first time,
+// identifiers known to the user registry can always log in
+type RegistrationConfig struct {
+	// `open` (default): everyone, `allowlist`: only identifiers matching
+	// policy.allowedAddresses or policy.allowedDomains, known users are
+	// exempt from that allowlist. `invite`: only identifiers with a
+	// pending invitation
+	Mode string `yaml:"mode"`
+	// How long invitations are valid, defaults to 7 days
+	InvitationLifetimeSeconds uint64 `yaml:"invitationLifetimeSeconds"`
+	// Page of your frontend that starts the login, invitations link to it
+	// with `identifier` appended as query parameter
+	InvitationURL string `yaml:"invitationURL"`
+}
+
+func (c RegistrationConfig) GetMode() string {
+	if len(c.Mode) == 0 {
+		return "open"
+	}
+	return c.Mode
+}
+
+func (c RegistrationConfig) InvitationLifetime() time.Duration {
+	if c.InvitationLifetimeSeconds == 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Second * time.Duration(c.InvitationLifetimeSeconds)
 }
 
 type Config struct {
 	ListenPort uint16 `yaml:"listenPort"`
+	// Optional path of a Unix socket to listen on instead of listenPort
+	ListenSocket string `yaml:"listenSocket"`
+	// See TLSConfig
+	TLS TLSConfig `yaml:"tls"`
+	// See CORSConfig
+	CORS CORSConfig `yaml:"cors"`
+	// Addresses or CIDRs of reverse proxies, the client IP is taken from
+	// Forwarded or X-Forwarded-For only if a request comes from one of
+	// them
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// Treat the peer of connections on listenSocket as a trusted proxy,
+	// e.g. a reverse proxy on the same host
+	TrustUnixSocketPeer bool `yaml:"trustUnixSocketPeer"`
 	// How long LoginTokens should be valid / stored
 	LoginTokenLifeTimeSeconds uint64 `yaml:"loginTokenLifeTimeSeconds"`
 	// How many LoginTokens can be generated before rejecting new
@@ -24,11 +465,66 @@ type Config struct {
 	MaxLoginTokenCount uint16 `yaml:"maxLoginTokenCount"`
 	// See SMTPConfig
 	SMTP SMTPConfig `yaml:"smtp"`
+	// See SMSConfig
+	SMS SMSConfig `yaml:"sms"`
+	// See WebhookConfig
+	Webhook WebhookConfig `yaml:"webhook"`
+	// Routes are evaluated in order, the first matching route selects
+	// the agents. Without a match e-mail addresses go to `smtp` and phone
+	// numbers to `sms`
+	Routes []RouteConfig `yaml:"routes"`
+	// See DevConfig
+	Dev DevConfig `yaml:"dev"`
+	// See AdminConfig
+	Admin AdminConfig `yaml:"admin"`
+	// See PolicyConfig
+	Policy PolicyConfig `yaml:"policy"`
+	// See IdentifierConfig
+	Identifiers IdentifierConfig `yaml:"identifiers"`
+	// See RegistrationConfig
+	Registration RegistrationConfig `yaml:"registration"`
+	// See AuditConfig
+	Audit AuditConfig `yaml:"audit"`
+	// See MetricsConfig
+	Metrics MetricsConfig `yaml:"metrics"`
+	// See TracingConfig
+	Tracing TracingConfig `yaml:"tracing"`
+	// See ReadinessConfig
+	Readiness ReadinessConfig `yaml:"readiness"`
+	// See ServerConfig
+	Server ServerConfig `yaml:"server"`
+	// See UniformResponseConfig
+	UniformLoginResponse UniformResponseConfig `yaml:"uniformLoginResponse"`
+	// Maps role names to the scopes they grant, e.g.
+	// `admin: ["admin:read", "admin:write"]`. Scopes ending with `:*`
+	// cover all scopes with that prefix
+	Roles map[string][]string `yaml:"roles"`
+	// Roles every user has
+	DefaultRoles []string `yaml:"defaultRoles"`
+	// Roles per identifier, in addition to the roles stored in the user
+	// registry. The keys are canonicalized like the identifiers of
+	// requests and must not collide
+	RoleAssignments map[string][]string `yaml:"roleAssignments"`
+	// Maps claim names to fields of the user registry, these claims are
+	// added to access tokens under `claims`. Fields are id, identifier,
+	// displayName, roles, createdAt, lastLoginAt and attributes.<name>
+	AccessTokenClaims map[string]string `yaml:"accessTokenClaims"`
 	// Can either be `alpha` or `numeric`
 	TokenFormat string `yaml:"tokenFormat"`
 	TokenLength int    `yaml:"tokenLength"`
 	// this will show up in emails
 	ServiceName string `yaml:"serviceName"`
+	// See TemplatesConfig
+	Templates TemplatesConfig `yaml:"templates"`
+	// Optional, linked in messages
+	SupportURL string `yaml:"supportURL"`
+	// Optional, the page of your frontend that completes a login. If set,
+	// messages contain a link to it with `identifier` and `token`
+	// appended as query parameters
+	LoginURL string `yaml:"loginURL"`
+	// Language used if neither the request nor the recorded locale of
+	// the identifier match a template language, defaults to `en`
+	DefaultLocale string `yaml:"defaultLocale"`
 	// where the database is stored
 	StatePath string `yaml:"statePath"`
 	// where the signing keys are stored
@@ -39,10 +535,71 @@ type Config struct {
 	RefreshTokenLifetimeSeconds uint64 `yaml:"refreshTokenLifetimeSeconds"`
 }
 
+// Fields of a user that can be mapped to claims
+var UserFields = []string{"id", "identifier", "displayName", "roles", "createdAt", "lastLoginAt"}
+
+func IsUserField(field string) bool {
+	if strings.HasPrefix(field, "attributes.") && len(field) > len("attributes.") {
+		return true
+	}
+	for _, f := range UserFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) GetDefaultLocale() string {
+	if len(c.DefaultLocale) == 0 {
+		return "en"
+	}
+	return c.DefaultLocale
+}
+
+// TrustedProxyNetworks parses TrustedProxies, single addresses are
+// treated as /32 or /128 networks
+func (c Config) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, proxy := range c.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %q", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 func (c Config) Validate() error {
-	if c.ListenPort == 0 {
+	if c.ListenPort == 0 && len(c.ListenSocket) == 0 {
 		return errors.New("Invalid listenPort")
 	}
+	if err := c.TLS.Validate(); err != nil {
+		return err
+	}
+	if _, err := c.TrustedProxyNetworks(); err != nil {
+		return err
+	}
+	if err := c.CORS.API.Validate("api"); err != nil {
+		return err
+	}
+	if err := c.CORS.Admin.Validate("admin"); err != nil {
+		return err
+	}
 	if !(c.TokenFormat == "alpha" || c.TokenFormat == "numeric") {
 		return errors.New("tokenFormat not `alpha` or `numeric`")
 	}
@@ -58,6 +615,58 @@ func (c Config) Validate() error {
 	if c.RefreshTokenLifetimeSeconds == 0 {
 		return errors.New("refreshTokenLifetimeSeconds must be set")
 	}
+	if err := c.SMTP.DKIM.Validate(); err != nil {
+		return err
+	}
+	if _, err := c.Templates.Location(); err != nil {
+		return fmt.Errorf("Invalid templates.timeZone: %v", err)
+	}
+	if len(c.LoginURL) > 0 {
+		if _, err := url.Parse(c.LoginURL); err != nil {
+			return fmt.Errorf("Invalid loginURL: %v", err)
+		}
+	}
+	switch c.Registration.GetMode() {
+	case "open", "allowlist", "invite":
+	default:
+		return errors.New("registration.mode not `open`, `allowlist` or `invite`")
+	}
+	switch c.Tracing.Exporter {
+	case "", "otlp", "stdout":
+	default:
+		return errors.New("tracing.exporter not `otlp` or `stdout`")
+	}
+	if ratio := c.Tracing.GetSampleRatio(); ratio < 0 || ratio > 1 {
+		return errors.New("tracing.sampleRatio not between 0 and 1")
+	}
+	if c.UniformLoginResponse.Enabled && c.UniformLoginResponse.Delay() >= c.Server.WriteTimeout() {
+		return errors.New("uniformLoginResponse.delayMilliseconds must be shorter than server.writeTimeoutSeconds")
+	}
+	for _, role := range c.DefaultRoles {
+		if _, ok := c.Roles[role]; !ok {
+			return fmt.Errorf("Unknown default role %q", role)
+		}
+	}
+	for id, roles := range c.RoleAssignments {
+		for _, role := range roles {
+			if _, ok := c.Roles[role]; !ok {
+				return fmt.Errorf("Unknown role %q assigned to %s", role, id)
+			}
+		}
+	}
+	for claim, field := range c.AccessTokenClaims {
+		if !IsUserField(field) {
+			return fmt.Errorf("Unknown user field %q for claim %q", field, claim)
+		}
+	}
+	if c.Dev.OutboxSize < 0 {
+		return errors.New("dev.outboxSize must not be negative")
+	}
+	for _, route := range c.Routes {
+		if err := route.Validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,170 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/rs/zerolog/log"
+)
+
+// CertificateStore holds the TLS certificate of the server and the CAs of
+// client certificates and replaces them when the files on disk change
+type CertificateStore struct {
+	mutex        sync.RWMutex
+	certPath     string
+	keyPath      string
+	clientCAPath string
+	certificate  *tls.Certificate
+	clientCAs    *x509.CertPool
+	modTime      time.Time
+}
+
+// NewCertificateStore loads certificate and key, clientCAPath is optional
+func NewCertificateStore(certPath string, keyPath string, clientCAPath string) (*CertificateStore, error) {
+	store := &CertificateStore{
+		certPath:     certPath,
+		keyPath:      keyPath,
+		clientCAPath: clientCAPath,
+	}
+	err := store.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *CertificateStore) paths() []string {
+	paths := []string{s.certPath, s.keyPath}
+	if len(s.clientCAPath) > 0 {
+		paths = append(paths, s.clientCAPath)
+	}
+	return paths
+}
+
+// lastModified returns the newest modification time of all files
+func (s *CertificateStore) lastModified() (time.Time, error) {
+	latest := time.Time{}
+	for _, path := range s.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func readCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("No certificates found in tls.clientCAPath")
+	}
+	return pool, nil
+}
+
+// Reload reads certificate, key and the client CAs, the previous ones are
+// kept if one of them cannot be loaded
+func (s *CertificateStore) Reload() error {
+	modTime, err := s.lastModified()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(s.certPath, s.keyPath)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if len(s.clientCAPath) > 0 {
+		clientCAs, err = readCertPool(s.clientCAPath)
+		if err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.certificate = &certificate
+	s.clientCAs = clientCAs
+	s.modTime = modTime
+	return nil
+}
+
+// GetCertificate can be used as `tls.Config.GetCertificate`
+func (s *CertificateStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.certificate, nil
+}
+
+// Watch reloads the certificates whenever one of the files changes, it
+// blocks until stop is closed
+func (s *CertificateStore) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			modTime, err := s.lastModified()
+			if err != nil {
+				log.Warn().Str("module", "crypto").Msgf("Could not check certificate: %v", err)
+				continue
+			}
+			s.mutex.RLock()
+			changed := !modTime.Equal(s.modTime)
+			s.mutex.RUnlock()
+			if !changed {
+				continue
+			}
+			err = s.Reload()
+			if err != nil {
+				log.Error().Str("module", "crypto").Msgf("Keeping previous certificate: %v", err)
+				continue
+			}
+			log.Info().Str("module", "crypto").Msg("Reloaded certificates")
+		}
+	}
+}
+
+// ClientCAs returns the current pool of client CAs, nil if no
+// clientCAPath is set
+func (s *CertificateStore) ClientCAs() *x509.CertPool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.clientCAs
+}
+
+// ServerTLSConfig returns the TLS configuration of the server. Client
+// certificates are verified against the current CAs of the store if sent
+// but only required by the admin routes, see
+// `middleware.WithAdminTokenHandler`. The verification applies to the
+// whole listener: a client sending a certificate of another CA fails the
+// handshake on every route.
+func ServerTLSConfig(tlsConfig config.TLSConfig, store *CertificateStore) *tls.Config {
+	result := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: store.GetCertificate,
+	}
+	if len(tlsConfig.ClientCAPath) > 0 {
+		base := result.Clone()
+		result.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			perConnection := base.Clone()
+			perConnection.ClientCAs = store.ClientCAs()
+			perConnection.ClientAuth = tls.VerifyClientCertIfGiven
+			return perConnection, nil
+		}
+	}
+	return result
+}
@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mguentner/passwordless/config"
+)
+
+func writeSelfSignedCertificate(t *testing.T, certPath string, keyPath string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, store *CertificateStore) string {
+	certificate, err := store.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateStoreWatch(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	writeSelfSignedCertificate(t, certPath, keyPath, "first")
+	store, err := NewCertificateStore(certPath, keyPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go store.Watch(10*time.Millisecond, stop)
+
+	// Make sure the modification time differs on coarse file systems
+	time.Sleep(20 * time.Millisecond)
+	writeSelfSignedCertificate(t, certPath, keyPath, "second")
+	deadline := time.Now().Add(5 * time.Second)
+	for commonName(t, store) != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the certificate to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = ioutil.WriteFile(keyPath, []byte("broken"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Reload()
+	if err == nil {
+		t.Error("Expected an invalid key to fail")
+	}
+	if commonName(t, store) != "second" {
+		t.Error("Expected the previous certificate to be kept")
+	}
+}
+
+func TestServerTLSConfigReloadsClientCAs(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	caPath := filepath.Join(dir, "ca.pem")
+	writeSelfSignedCertificate(t, certPath, keyPath, "server")
+	writeSelfSignedCertificate(t, caPath, filepath.Join(dir, "ca-key.pem"), "first")
+	store, err := NewCertificateStore(certPath, keyPath, caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := ServerTLSConfig(config.TLSConfig{CertPath: certPath, KeyPath: keyPath, ClientCAPath: caPath}, store)
+	first, err := tlsConfig.GetConfigForClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ClientAuth != tls.VerifyClientCertIfGiven || first.ClientCAs == nil {
+		t.Fatalf("Expected client certificates to be verified, got %+v", first)
+	}
+
+	writeSelfSignedCertificate(t, caPath, filepath.Join(dir, "ca-key.pem"), "second")
+	err = store.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tlsConfig.GetConfigForClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ClientCAs.Equal(first.ClientCAs) {
+		t.Error("Expected the reloaded client CAs to be used for new connections")
+	}
+
+	err = ioutil.WriteFile(caPath, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Reload() == nil {
+		t.Fatal("Expected an invalid CA bundle to be rejected")
+	}
+	if !store.ClientCAs().Equal(second.ClientCAs) {
+		t.Error("Expected the previous client CAs to be kept")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -86,10 +87,13 @@ func ReadRSAKeysFromPath(path string) ([]PublicPrivateRSAKeyPair, error) {
 	return result, nil
 }
 
+// GetKeyForTime returns the newest key that is valid at the given time or
+// nil. keyPairs is not modified so it can be shared between requests.
 func GetKeyForTime(keyPairs []PublicPrivateRSAKeyPair, time time.Time) *PublicPrivateRSAKeyPair {
 	unixTime := time.Unix()
-	sort.Sort(sort.Reverse(ByValidFrom(keyPairs)))
-	for _, keyPair := range keyPairs {
+	sorted := append([]PublicPrivateRSAKeyPair{}, keyPairs...)
+	sort.Sort(sort.Reverse(ByValidFrom(sorted)))
+	for _, keyPair := range sorted {
 		if keyPair.ValidFrom < unixTime {
 			return &keyPair
 		}
@@ -107,6 +111,13 @@ func GetAllPublicKeys(keyPairs []PublicPrivateRSAKeyPair) []rsa.PublicKey {
 
 type UserInfo struct {
 	Identifier string
+	Roles      []string `json:"roles,omitempty"`
+	// Space separated like OAuth 2.0 scopes
+	Scope string `json:"scope,omitempty"`
+	// Claims mapped from the user registry, see accessTokenClaims
+	Claims map[string]interface{} `json:"claims,omitempty"`
+	// Session generation of the user, only set in refresh tokens
+	Session uint64 `json:"session,omitempty"`
 }
 
 type DefaultClaims struct {
@@ -115,11 +126,47 @@ type DefaultClaims struct {
 	UserInfo
 }
 
-func createToken(keyPairs []PublicPrivateRSAKeyPair, forTime time.Time, lifeTimeSeconds int64, tokenType string, userInfo UserInfo) (string, error) {
+func (c *DefaultClaims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// ScopeMatches reports whether granted covers required, `admin:*` covers
+// `admin:read` and `*` covers everything
+func ScopeMatches(granted string, required string) bool {
+	if granted == required || granted == "*" {
+		return true
+	}
+	if strings.HasSuffix(granted, ":*") {
+		return strings.HasPrefix(required, strings.TrimSuffix(granted, "*"))
+	}
+	return false
+}
+
+func (c *DefaultClaims) HasScope(scope string) bool {
+	for _, granted := range c.Scopes() {
+		if ScopeMatches(granted, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DefaultClaims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func createToken(keyPairs []PublicPrivateRSAKeyPair, forTime time.Time, lifeTimeSeconds int64, tokenType string, subject string, userInfo UserInfo) (string, error) {
 	t := jwt.New(jwt.GetSigningMethod("RS256"))
 	t.Claims = &DefaultClaims{
 		&jwt.StandardClaims{
 			ExpiresAt: time.Now().Add(time.Second * time.Duration(lifeTimeSeconds)).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Subject:   subject,
 		},
 		tokenType,
 		userInfo,
@@ -132,16 +179,30 @@ func createToken(keyPairs []PublicPrivateRSAKeyPair, forTime time.Time, lifeTime
 }
 
 func CreateAccessToken(config config.Config, keyPairs []PublicPrivateRSAKeyPair, identifier string) (string, error) {
-	now := time.Now()
-	return createToken(keyPairs, now, int64(config.AccessTokenLifetimeSeconds), "access", UserInfo{
+	return CreateUserAccessToken(config, keyPairs, "", UserInfo{
 		Identifier: identifier,
 	})
 }
 
 func CreateRefreshToken(config config.Config, keyPairs []PublicPrivateRSAKeyPair, identifier string) (string, error) {
+	return CreateUserRefreshToken(config, keyPairs, "", identifier, 0)
+}
+
+// CreateUserAccessToken issues an access token, subject is the id of the
+// user
+func CreateUserAccessToken(config config.Config, keyPairs []PublicPrivateRSAKeyPair, subject string, userInfo UserInfo) (string, error) {
+	now := time.Now()
+	return createToken(keyPairs, now, int64(config.AccessTokenLifetimeSeconds), "access", subject, userInfo)
+}
+
+// CreateUserRefreshToken issues a refresh token, it never carries custom
+// claims as these are looked up again on refresh. session is the session
+// generation of the user.
+func CreateUserRefreshToken(config config.Config, keyPairs []PublicPrivateRSAKeyPair, subject string, identifier string, session uint64) (string, error) {
 	now := time.Now()
-	return createToken(keyPairs, now, int64(config.RefreshTokenLifetimeSeconds), "refresh", UserInfo{
+	return createToken(keyPairs, now, int64(config.RefreshTokenLifetimeSeconds), "refresh", subject, UserInfo{
 		Identifier: identifier,
+		Session:    session,
 	})
 }
 
@@ -1,8 +1,7 @@
 package deliver
 
 import (
-	"errors"
-	"net/mail"
+	"context"
 
 	"github.com/mguentner/passwordless/config"
 )
@@ -11,11 +10,50 @@ type DeliverAgent interface {
 	Deliver(config config.Config, identifier string, subject string, body string) error
 }
 
-func AgentForIdentifier(identifier string) (DeliverAgent, error) {
-	_, err := mail.ParseAddress(identifier)
-	if err == nil {
-		agent := SMTPAgent{}
-		return &agent, nil
+// A rendered message, HTMLBody is optional
+type Message struct {
+	Subject  string
+	Body     string
+	HTMLBody string
+}
+
+// MessageDeliverAgent is implemented by agents that can make use of all
+// parts of a Message, e.g. to send HTML mails
+type MessageDeliverAgent interface {
+	DeliverAgent
+	DeliverMessage(config config.Config, identifier string, message Message) error
+}
+
+// ContextDeliverAgent is implemented by agents that make use of the
+// context of the delivery to trace outgoing requests and to give up once
+// it is cancelled. It is preferred over the other interfaces.
+type ContextDeliverAgent interface {
+	DeliverAgent
+	DeliverContext(ctx context.Context, config config.Config, identifier string, message Message) error
+}
+
+func deliverMessage(ctx context.Context, agent DeliverAgent, config config.Config, identifier string, message Message) error {
+	if contextAgent, ok := agent.(ContextDeliverAgent); ok {
+		return contextAgent.DeliverContext(ctx, config, identifier, message)
+	}
+	if messageAgent, ok := agent.(MessageDeliverAgent); ok {
+		return messageAgent.DeliverMessage(config, identifier, message)
+	}
+	return agent.Deliver(config, identifier, message.Subject, message.Body)
+}
+
+// Agents can be added by applications embedding passwordless and then be
+// referenced in `routes` by their name
+func Register(name string, agent DeliverAgent) {
+	DefaultRegistry.Register(name, agent)
+}
+
+// AgentForIdentifier returns the primary agent for the identifier, use
+// DefaultRegistry.Deliver to also make use of the fallbacks
+func AgentForIdentifier(config config.Config, id string) (DeliverAgent, error) {
+	names, err := DefaultRegistry.Route(config, id)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("Unknown identifier format")
+	return DefaultRegistry.Agent(names[0])
 }
@@ -0,0 +1,142 @@
+package deliver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mguentner/passwordless/config"
+)
+
+// The agents in this file are meant for local development and testing,
+// they do not deliver anything to the recipient.
+
+// LogAgent prints every message to Writer (stdout if nil)
+type LogAgent struct {
+	Writer io.Writer
+}
+
+func (h LogAgent) Deliver(config config.Config, identifier string, subject string, body string) error {
+	writer := h.Writer
+	if writer == nil {
+		writer = os.Stdout
+	}
+	_, err := fmt.Fprintf(writer, "----- message for %s -----\nSubject: %s\n\n%s\n-----\n", identifier, subject, body)
+	return err
+}
+
+// FileAgent writes every message as a separate file into a maildir
+// located at `dev.fileDeliveryPath`, any mail client can open it.
+type FileAgent struct {
+}
+
+func (h FileAgent) Deliver(config config.Config, identifier string, subject string, body string) error {
+	return h.DeliverMessage(config, identifier, Message{Subject: subject, Body: body})
+}
+
+func (h FileAgent) DeliverMessage(config config.Config, identifier string, message Message) error {
+	path := config.Dev.FileDeliveryPath
+	if len(path) == 0 {
+		return errors.New("dev.fileDeliveryPath is not set")
+	}
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(path, dir), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	msg, err := composeMessage(config, identifier, message)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 8)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	name := fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), hex.EncodeToString(nonce), hostname)
+	tmpPath := filepath.Join(path, "tmp", name)
+	err = ioutil.WriteFile(tmpPath, msg, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(path, "new", name))
+}
+
+type OutboxMessage struct {
+	Identifier string    `json:"identifier"`
+	Subject    string    `json:"subject"`
+	Body       string    `json:"body"`
+	Time       time.Time `json:"time"`
+}
+
+// Outbox keeps the last messages in memory
+type Outbox struct {
+	mutex    sync.Mutex
+	size     int
+	messages []OutboxMessage
+}
+
+func NewOutbox(size int) *Outbox {
+	return &Outbox{
+		size:     size,
+		messages: []OutboxMessage{},
+	}
+}
+
+func (o *Outbox) Add(message OutboxMessage) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.messages = append(o.messages, message)
+	if len(o.messages) > o.size {
+		o.messages = o.messages[len(o.messages)-o.size:]
+	}
+}
+
+func (o *Outbox) Resize(size int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.size = size
+	if len(o.messages) > o.size {
+		o.messages = o.messages[len(o.messages)-o.size:]
+	}
+}
+
+// Last returns up to n messages, newest first
+func (o *Outbox) Last(n int) []OutboxMessage {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	result := []OutboxMessage{}
+	for i := len(o.messages) - 1; i >= 0 && len(result) < n; i-- {
+		result = append(result, o.messages[i])
+	}
+	return result
+}
+
+// The outbox used by the `outbox` agent
+var DefaultOutbox = NewOutbox(100)
+
+type OutboxAgent struct {
+	Outbox *Outbox
+}
+
+func (h OutboxAgent) Deliver(config config.Config, identifier string, subject string, body string) error {
+	h.Outbox.Add(OutboxMessage{
+		Identifier: identifier,
+		Subject:    subject,
+		Body:       body,
+		Time:       time.Now(),
+	})
+	return nil
+}
@@ -0,0 +1,69 @@
+package deliver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mguentner/passwordless/test"
+)
+
+func TestLogAgent(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	agent := LogAgent{Writer: buffer}
+	err := agent.Deliver(test.DefaultConfig(), "foo@bar.com", "subject", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "foo@bar.com") || !strings.Contains(buffer.String(), "1234") {
+		t.Fatalf("Unexpected output: %s", buffer.String())
+	}
+}
+
+func TestFileAgent(t *testing.T) {
+	c := test.DefaultConfig()
+	c.Dev.FileDeliveryPath = t.TempDir()
+	agent := FileAgent{}
+	err := agent.Deliver(c, "foo@bar.com", "subject", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(c.Dev.FileDeliveryPath, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected exactly one message, got %d", len(files))
+	}
+	msg, err := ioutil.ReadFile(filepath.Join(c.Dev.FileDeliveryPath, "new", files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(msg, []byte("To: foo@bar.com")) {
+		t.Fatalf("Unexpected message: %s", msg)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	outbox := NewOutbox(2)
+	agent := OutboxAgent{Outbox: outbox}
+	for _, body := range []string{"1", "2", "3"} {
+		err := agent.Deliver(test.DefaultConfig(), "foo@bar.com", "subject", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages := outbox.Last(10)
+	if len(messages) != 2 {
+		t.Fatalf("Expected exactly two messages, got %d", len(messages))
+	}
+	if messages[0].Body != "3" || messages[1].Body != "2" {
+		t.Fatalf("Expected the newest messages first, got %+v", messages)
+	}
+	messages = outbox.Last(1)
+	if len(messages) != 1 || messages[0].Body != "3" {
+		t.Fatalf("Expected only the newest message, got %+v", messages)
+	}
+}
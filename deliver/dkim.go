@@ -0,0 +1,86 @@
+package deliver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/mguentner/passwordless/config"
+)
+
+// Header fields covered by the signature, see RFC 6376 section 5.4.1
+var dkimHeaderKeys = []string{"From", "To", "Subject", "Date", "Message-ID"}
+
+func ReadDKIMPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found in DKIM private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("DKIM private key cannot be used for signing")
+	}
+	return signer, nil
+}
+
+var (
+	dkimMutex   sync.Mutex
+	dkimSigners = map[string]crypto.Signer{}
+)
+
+// LoadDKIMSigner reads the private key at path, it is cached for all
+// subsequent messages. Call it at startup to fail early on a bad key.
+func LoadDKIMSigner(path string) (crypto.Signer, error) {
+	dkimMutex.Lock()
+	defer dkimMutex.Unlock()
+	if signer, ok := dkimSigners[path]; ok {
+		return signer, nil
+	}
+	signer, err := ReadDKIMPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	dkimSigners[path] = signer
+	return signer, nil
+}
+
+func DKIMSignOptions(dkimConfig config.DKIMConfig) (*dkim.SignOptions, error) {
+	signer, err := LoadDKIMSigner(dkimConfig.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &dkim.SignOptions{
+		Domain:                 dkimConfig.Domain,
+		Selector:               dkimConfig.Selector,
+		Signer:                 signer,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             dkimHeaderKeys,
+	}, nil
+}
+
+// SignMessage prepends a DKIM-Signature header to msg
+func SignMessage(options *dkim.SignOptions, msg []byte) ([]byte, error) {
+	signed := &bytes.Buffer{}
+	err := dkim.Sign(signed, bytes.NewReader(msg), options)
+	if err != nil {
+		return nil, err
+	}
+	return signed.Bytes(), nil
+}
@@ -0,0 +1,109 @@
+package deliver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/test"
+)
+
+func writeDKIMKey(t *testing.T) (string, *rsa.PrivateKey) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "dkim.key")
+	pemData := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+	err = ioutil.WriteFile(keyPath, pemData, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPath, privateKey
+}
+
+func TestComposeMessageDKIM(t *testing.T) {
+	keyPath, privateKey := writeDKIMKey(t)
+	c := test.DefaultConfig()
+	c.SMTP.DKIM = config.DKIMConfig{
+		Domain:         "example.com",
+		Selector:       "passwordless",
+		PrivateKeyPath: keyPath,
+	}
+	msg, err := composeMessage(c, "bob@example.org", Message{Subject: "Your token", Body: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupTXT := func(domain string) ([]string, error) {
+		if domain != "passwordless._domainkey.example.com" {
+			return nil, fmt.Errorf("unexpected lookup for %s", domain)
+		}
+		return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(publicKey)}, nil
+	}
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{
+		LookupTXT: lookupTXT,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifications) != 1 {
+		t.Fatalf("Expected exactly one signature, got %d", len(verifications))
+	}
+	if verifications[0].Err != nil {
+		t.Fatalf("Expected the signature to be valid: %v", verifications[0].Err)
+	}
+	if verifications[0].Domain != "example.com" {
+		t.Fatalf("Expected domain example.com, got %s", verifications[0].Domain)
+	}
+}
+
+func TestComposeMessageWithoutDKIM(t *testing.T) {
+	c := test.DefaultConfig()
+	msg, err := composeMessage(c, "bob@example.org", Message{Subject: "Your token", Body: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(msg, []byte("DKIM-Signature")) {
+		t.Fatal("Expected the message to be unsigned")
+	}
+}
+
+func TestLoadDKIMSigner(t *testing.T) {
+	keyPath, privateKey := writeDKIMKey(t)
+	signer, err := LoadDKIMSigner(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privateKey.PublicKey.Equal(signer.Public()) {
+		t.Fatal("Expected the signer of the written key")
+	}
+	// The parsed key is kept, the file is not read again
+	err = ioutil.WriteFile(keyPath, []byte("broken"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadDKIMSigner(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadDKIMSigner(filepath.Join(t.TempDir(), "missing.key"))
+	if err == nil {
+		t.Fatal("Expected a missing key to fail")
+	}
+}
@@ -0,0 +1,82 @@
+package deliver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/emersion/go-smtp"
+	"github.com/mguentner/passwordless/config"
+)
+
+// A ProbingAgent can check whether it is able to deliver messages without
+// sending one
+type ProbingAgent interface {
+	Probe(ctx context.Context, config config.Config) error
+}
+
+// Probe connects to the SMTP server and ends the session after the
+// greeting and a NOOP
+func (h SMTPAgent) Probe(ctx context.Context, config config.Config) error {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", config.SMTP.Host, config.SMTP.Port))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, config.SMTP.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	err = client.Noop()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// AgentsInUse returns the names of the agents referenced by routes and the
+// default agents of configured delivery methods
+func (r *Registry) AgentsInUse(config config.Config) []string {
+	names := map[string]bool{}
+	for _, route := range config.Routes {
+		names[route.Agent] = true
+		for _, fallback := range route.Fallbacks {
+			names[fallback] = true
+		}
+	}
+	if len(config.SMTP.Host) > 0 {
+		names["smtp"] = true
+	}
+	if config.SMS.Enabled() {
+		names["sms"] = true
+	}
+	result := []string{}
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Probe checks every agent in use that implements ProbingAgent, the result
+// maps the agent name to the error or nil
+func (r *Registry) Probe(ctx context.Context, config config.Config) map[string]error {
+	results := map[string]error{}
+	for _, name := range r.AgentsInUse(config) {
+		agent, err := r.Agent(name)
+		if err != nil {
+			results[name] = err
+			continue
+		}
+		if prober, ok := agent.(ProbingAgent); ok {
+			results[name] = prober.Probe(ctx, config)
+		}
+	}
+	return results
+}
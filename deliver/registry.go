@@ -0,0 +1,207 @@
+package deliver
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/identifier"
+	"github.com/mguentner/passwordless/metrics"
+	"github.com/mguentner/passwordless/tracing"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type NoSuchAgent struct {
+	Name string
+}
+
+func (e *NoSuchAgent) Error() string {
+	return fmt.Sprintf("NoSuchAgent: %s", e.Name)
+}
+
+type AllAgentsFailed struct {
+	Errors map[string]error
+}
+
+func (e *AllAgentsFailed) Error() string {
+	names := []string{}
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := []string{}
+	for _, name := range names {
+		messages = append(messages, fmt.Sprintf("%s: %v", name, e.Errors[name]))
+	}
+	return fmt.Sprintf("AllAgentsFailed (%s)", strings.Join(messages, ", "))
+}
+
+// Registry maps agent names to DeliverAgents and routes identifiers to
+// them based on `config.Routes`
+type Registry struct {
+	mutex  sync.RWMutex
+	agents map[string]DeliverAgent
+	// Compiled route patterns, see pattern
+	patterns map[string]*regexp.Regexp
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		agents:   map[string]DeliverAgent{},
+		patterns: map[string]*regexp.Regexp{},
+	}
+}
+
+// NewDefaultRegistry returns a registry containing all built in agents
+func NewDefaultRegistry() *Registry {
+	registry := NewRegistry()
+	registry.Register("smtp", &SMTPAgent{})
+	registry.Register("sms", &SMSAgent{})
+	registry.Register("webhook", &WebhookAgent{})
+	registry.Register("log", &LogAgent{})
+	registry.Register("file", &FileAgent{})
+	registry.Register("outbox", &OutboxAgent{Outbox: DefaultOutbox})
+	return registry
+}
+
+var DefaultRegistry = NewDefaultRegistry()
+
+// Register adds an agent, an existing agent with the same name is replaced
+func (r *Registry) Register(name string, agent DeliverAgent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.agents[name] = agent
+}
+
+func (r *Registry) Agent(name string) (DeliverAgent, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	agent, ok := r.agents[name]
+	if !ok {
+		return nil, &NoSuchAgent{Name: name}
+	}
+	return agent, nil
+}
+
+// pattern returns the compiled route pattern, every pattern is only
+// compiled once
+func (r *Registry) pattern(pattern string) (*regexp.Regexp, error) {
+	r.mutex.RLock()
+	regex, ok := r.patterns[pattern]
+	r.mutex.RUnlock()
+	if ok {
+		return regex, nil
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.patterns[pattern] = regex
+	return regex, nil
+}
+
+// ValidateRoutes checks that every agent referenced in `config.Routes` is
+// registered and compiles the route patterns, call this after all agents
+// have been registered.
+func (r *Registry) ValidateRoutes(config config.Config) error {
+	for _, route := range config.Routes {
+		if len(route.Pattern) > 0 {
+			_, err := r.pattern(route.Pattern)
+			if err != nil {
+				return err
+			}
+		}
+		names := append([]string{route.Agent}, route.Fallbacks...)
+		for _, name := range names {
+			_, err := r.Agent(name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Registry) routeMatches(route config.RouteConfig, kind identifier.Kind, id string) (bool, error) {
+	if len(route.Kind) > 0 && identifier.Kind(route.Kind) != kind {
+		return false, nil
+	}
+	if len(route.Domain) > 0 && !identifier.DomainMatches(route.Domain, identifier.Domain(id)) {
+		return false, nil
+	}
+	if len(route.Pattern) > 0 {
+		regex, err := r.pattern(route.Pattern)
+		if err != nil {
+			return false, err
+		}
+		if !regex.MatchString(id) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Route returns the names of the agents responsible for the identifier,
+// the primary agent first followed by its fallbacks
+func (r *Registry) Route(config config.Config, id string) ([]string, error) {
+	kind, err := identifier.KindOf(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range config.Routes {
+		matches, err := r.routeMatches(route, kind, id)
+		if err != nil {
+			return nil, err
+		}
+		if matches {
+			return append([]string{route.Agent}, route.Fallbacks...), nil
+		}
+	}
+	if kind == identifier.KindPhone {
+		return []string{"sms"}, nil
+	}
+	return []string{"smtp"}, nil
+}
+
+// Deliver sends the message through the primary agent of the identifier and
+// tries the fallbacks in order if it fails. Every attempt is traced as a
+// child of the span in ctx, agents implementing ContextDeliverAgent add
+// their own spans below it.
+func (r *Registry) Deliver(ctx context.Context, config config.Config, id string, message Message) error {
+	names, err := r.Route(config, id)
+	if err != nil {
+		return err
+	}
+	failed := &AllAgentsFailed{
+		Errors: map[string]error{},
+	}
+	for _, name := range names {
+		if ctx.Err() != nil {
+			// Do not try the fallbacks once the caller gave up
+			failed.Errors[name] = ctx.Err()
+			return failed
+		}
+		agent, err := r.Agent(name)
+		if err == nil {
+			spanContext, span := tracing.Start(ctx, "deliver."+name, attribute.String("deliver.agent", name))
+			start := time.Now()
+			err = deliverMessage(spanContext, agent, config, id, message)
+			metrics.ObserveDelivery(name, start, err)
+			tracing.End(span, err)
+		}
+		if err == nil {
+			return nil
+		}
+		log.Warn().Str("module", "deliver").Msgf("Delivery through %s failed: %v", name, err)
+		failed.Errors[name] = err
+	}
+	return failed
+}
@@ -0,0 +1,140 @@
+package deliver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/test"
+)
+
+type failingAgent struct{}
+
+func (h failingAgent) Deliver(config config.Config, identifier string, subject string, body string) error {
+	return errors.New("failed")
+}
+
+func TestAgentForIdentifier(t *testing.T) {
+	c := test.DefaultConfig()
+	agent, err := AgentForIdentifier(c, "+491701234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := agent.(*SMSAgent); !ok {
+		t.Error("Expected an SMSAgent for a phone number")
+	}
+	agent, err = AgentForIdentifier(c, "foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := agent.(*SMTPAgent); !ok {
+		t.Error("Expected an SMTPAgent for an email address")
+	}
+	_, err = AgentForIdentifier(c, "foo")
+	if err == nil {
+		t.Error("Expected an error for an unknown identifier")
+	}
+}
+
+func TestRegistryRoute(t *testing.T) {
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{
+		{Domain: "*.chat.example.com", Agent: "webhook"},
+		{Domain: "example.com", Agent: "smtp", Fallbacks: []string{"webhook"}},
+		{Kind: "phone", Pattern: `^\+1`, Agent: "webhook"},
+	}
+	registry := NewDefaultRegistry()
+	testSet := []struct {
+		identifier string
+		expected   []string
+	}{
+		{identifier: "alice@team.chat.example.com", expected: []string{"webhook"}},
+		{identifier: "alice@chat.example.com", expected: []string{"smtp"}},
+		{identifier: "alice@Example.com", expected: []string{"smtp", "webhook"}},
+		{identifier: "+14155552671", expected: []string{"webhook"}},
+		{identifier: "+491701234567", expected: []string{"sms"}},
+	}
+	for _, test := range testSet {
+		names, err := registry.Route(c, test.identifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != len(test.expected) {
+			t.Errorf("Expected %v for %s but got %v", test.expected, test.identifier, names)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("Expected %v for %s but got %v", test.expected, test.identifier, names)
+			}
+		}
+	}
+}
+
+func TestRegistryDeliverFallback(t *testing.T) {
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{
+		{Agent: "broken", Fallbacks: []string{"alsoBroken", "outbox"}},
+	}
+	outbox := NewOutbox(10)
+	registry := NewRegistry()
+	registry.Register("broken", &failingAgent{})
+	registry.Register("alsoBroken", &failingAgent{})
+	registry.Register("outbox", &OutboxAgent{Outbox: outbox})
+	err := registry.ValidateRoutes(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.Deliver(context.Background(), c, "foo@bar.com", Message{Subject: "subject", Body: "body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox.Last(10)) != 1 {
+		t.Fatal("Expected the fallback to receive the message")
+	}
+
+	c.Routes[0].Fallbacks = []string{"alsoBroken"}
+	err = registry.Deliver(context.Background(), c, "foo@bar.com", Message{Subject: "subject", Body: "body"})
+	failed, ok := err.(*AllAgentsFailed)
+	if !ok {
+		t.Fatalf("Expected AllAgentsFailed, got %v", err)
+	}
+	if len(failed.Errors) != 2 {
+		t.Fatalf("Expected two errors, got %v", failed.Errors)
+	}
+}
+
+func TestRegistryValidateRoutes(t *testing.T) {
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{
+		{Agent: "smtp", Fallbacks: []string{"doesnotexist"}},
+	}
+	registry := NewDefaultRegistry()
+	err := registry.ValidateRoutes(c)
+	if _, ok := err.(*NoSuchAgent); !ok {
+		t.Fatalf("Expected NoSuchAgent, got %v", err)
+	}
+
+	c.Routes = []config.RouteConfig{{Agent: "sms", Pattern: `^\+49`}}
+	err = registry.ValidateRoutes(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled := registry.patterns[`^\+49`]
+	if compiled == nil {
+		t.Fatal("Expected the pattern to be compiled")
+	}
+	_, err = registry.Route(c, "+491701234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry.patterns[`^\+49`] != compiled {
+		t.Error("Expected Route to reuse the compiled pattern")
+	}
+	c.Routes = []config.RouteConfig{{Agent: "sms", Pattern: `(`}}
+	err = registry.ValidateRoutes(c)
+	if err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
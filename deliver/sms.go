@@ -0,0 +1,119 @@
+package deliver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const defaultSMSBodyTemplate = `{"from":{{json .From}},"to":{{json .To}},"text":{{json .Body}}}`
+
+type SMSGatewayError struct {
+	StatusCode int
+}
+
+func (e *SMSGatewayError) Error() string {
+	return fmt.Sprintf("SMSGatewayError: status %d", e.StatusCode)
+}
+
+type smsTemplateData struct {
+	From string
+	To   string
+	Body string
+}
+
+var smsTemplateFuncs = template.FuncMap{
+	"json": func(s string) (string, error) {
+		data, err := json.Marshal(s)
+		return string(data), err
+	},
+}
+
+// SMSAgent posts messages to an HTTP SMS gateway. The request body is
+// rendered from `sms.bodyTemplate` which covers the APIs of most providers.
+type SMSAgent struct {
+}
+
+func renderSMSRequestBody(smsConfig config.SMSConfig, identifier string, body string) (string, error) {
+	bodyTemplate := smsConfig.BodyTemplate
+	if len(bodyTemplate) == 0 {
+		bodyTemplate = defaultSMSBodyTemplate
+	}
+	parsedTemplate, err := template.New("sms").Funcs(smsTemplateFuncs).Parse(bodyTemplate)
+	if err != nil {
+		return "", err
+	}
+	sBuilder := &strings.Builder{}
+	err = parsedTemplate.Execute(sBuilder, smsTemplateData{
+		From: smsConfig.From,
+		To:   identifier,
+		Body: body,
+	})
+	if err != nil {
+		return "", err
+	}
+	return sBuilder.String(), nil
+}
+
+func (h SMSAgent) Deliver(config config.Config, identifier string, subject string, body string) error {
+	return h.DeliverContext(context.Background(), config, identifier, Message{Subject: subject, Body: body})
+}
+
+func (h SMSAgent) DeliverContext(ctx context.Context, config config.Config, identifier string, message Message) (err error) {
+	smsConfig := config.SMS
+	if !smsConfig.Enabled() {
+		return fmt.Errorf("SMS delivery is not configured")
+	}
+	requestBody, err := renderSMSRequestBody(smsConfig, identifier, message.Body)
+	if err != nil {
+		return err
+	}
+	method := smsConfig.Method
+	if len(method) == 0 {
+		method = http.MethodPost
+	}
+	ctx, span := tracing.Start(ctx, "sms.send", attribute.String("http.method", method))
+	defer func() { tracing.End(span, err) }()
+	request, err := http.NewRequestWithContext(ctx, method, smsConfig.GatewayURL, strings.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	contentType := smsConfig.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/json"
+	}
+	request.Header.Set("Content-Type", contentType)
+	for key, value := range smsConfig.Headers {
+		request.Header.Set(key, value)
+	}
+	if len(smsConfig.User) > 0 {
+		request.SetBasicAuth(smsConfig.User, smsConfig.Password)
+	}
+	tracing.Inject(ctx, request.Header)
+	timeout := time.Second * 10
+	if smsConfig.TimeoutSeconds > 0 {
+		timeout = time.Second * time.Duration(smsConfig.TimeoutSeconds)
+	}
+	client := &http.Client{Timeout: timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	span.SetAttributes(attribute.Int("http.status_code", response.StatusCode))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &SMSGatewayError{StatusCode: response.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package deliver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/test"
+)
+
+func TestSMSAgentDeliver(t *testing.T) {
+	var received map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		err := json.NewDecoder(r.Body).Decode(&received)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	c := test.DefaultConfig()
+	c.SMS = config.SMSConfig{
+		GatewayURL: server.URL,
+		From:       "Passwordless",
+		Headers: map[string]string{
+			"X-Api-Key": "secret",
+		},
+	}
+	agent := SMSAgent{}
+	err := agent.Deliver(c, "+491701234567", "", "1234 is your \"token\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received["to"] != "+491701234567" {
+		t.Errorf("Expected to to be +491701234567, got %s", received["to"])
+	}
+	if received["text"] != "1234 is your \"token\"" {
+		t.Errorf("Unexpected text: %s", received["text"])
+	}
+	if received["from"] != "Passwordless" {
+		t.Errorf("Unexpected from: %s", received["from"])
+	}
+
+	c.SMS.Headers = nil
+	err = agent.Deliver(c, "+491701234567", "", "1234")
+	if _, ok := err.(*SMSGatewayError); !ok {
+		t.Fatalf("Expected a SMSGatewayError, got %v", err)
+	}
+}
+
+func TestSMSRequestBodyTemplate(t *testing.T) {
+	smsConfig := config.SMSConfig{
+		BodyTemplate: "to={{urlquery .To}}&text={{urlquery .Body}}",
+	}
+	body, err := renderSMSRequestBody(smsConfig, "+491701234567", "1234 is your token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "to=%2B491701234567&text=1234+is+your+token"
+	if body != expected {
+		t.Fatalf("Expected %s, got %s", expected, body)
+	}
+}
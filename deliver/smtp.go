@@ -1,33 +1,196 @@
 package deliver
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/textproto"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type SMTPAgent struct {
 }
 
-func (h SMTPAgent) Deliver(config config.Config, identifier string, subject string, body string) error {
-	auth := sasl.NewPlainClient("", config.SMTP.User, config.SMTP.Password)
-	to := []string{identifier}
-	msg := strings.NewReader(
+func messageID(fromAddr string) (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	for i := len(fromAddr) - 1; i >= 0; i-- {
+		if fromAddr[i] == '@' {
+			domain = fromAddr[i+1:]
+			break
+		}
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(nonce), domain), nil
+}
+
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// composeBody returns the Content-Type and the body of the message, a
+// multipart/alternative body is used if a HTML variant is present
+func composeBody(message Message) (string, string, error) {
+	if len(message.HTMLBody) == 0 {
+		return "text/plain; charset=utf-8", crlf(message.Body) + "\r\n", nil
+	}
+	buffer := &bytes.Buffer{}
+	writer := multipart.NewWriter(buffer)
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{contentType: "text/plain; charset=utf-8", body: message.Body},
+		{contentType: "text/html; charset=utf-8", body: message.HTMLBody},
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "8bit")
+		partWriter, err := writer.CreatePart(header)
+		if err != nil {
+			return "", "", err
+		}
+		_, err = partWriter.Write([]byte(crlf(part.body) + "\r\n"))
+		if err != nil {
+			return "", "", err
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("multipart/alternative; boundary=%s", writer.Boundary()), buffer.String(), nil
+}
+
+func composeMessage(config config.Config, identifier string, message Message) ([]byte, error) {
+	msgID, err := messageID(config.SMTP.FromAddr)
+	if err != nil {
+		return nil, err
+	}
+	contentType, body, err := composeBody(message)
+	if err != nil {
+		return nil, err
+	}
+	msg := []byte(
 		fmt.Sprintf(
 			"From: %s\r\n"+
 				"To: %s\r\n"+
 				"Subject: %s\r\n"+
+				"Date: %s\r\n"+
+				"Message-ID: %s\r\n"+
+				"MIME-Version: 1.0\r\n"+
+				"Content-Type: %s\r\n"+
 				"\r\n"+
-				"%s\r\n", config.SMTP.FromAddr, identifier, subject, body),
+				"%s", config.SMTP.FromAddr, identifier, mime.QEncoding.Encode("utf-8", message.Subject), time.Now().Format(time.RFC1123Z), msgID, contentType, body),
 	)
-	err := smtp.SendMail(
-		fmt.Sprintf("%s:%d", config.SMTP.Host, config.SMTP.Port),
-		auth,
-		config.SMTP.FromAddr,
-		to,
-		msg)
-	return err
+	if config.SMTP.DKIM.Enabled() {
+		options, err := DKIMSignOptions(config.SMTP.DKIM)
+		if err != nil {
+			return nil, err
+		}
+		return SignMessage(options, msg)
+	}
+	return msg, nil
+}
+
+// sendMail does what smtp.SendMail does on a connection that is closed
+// once ctx is done
+func sendMail(ctx context.Context, host string, port uint16, auth sasl.Client, from string, to []string, msg []byte) error {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(nil)
+		if err != nil {
+			return err
+		}
+	}
+	if ok, _ := client.Extension("AUTH"); !ok {
+		return errors.New("smtp: server doesn't support AUTH")
+	}
+	err = client.Auth(auth)
+	if err != nil {
+		return err
+	}
+	err = client.Mail(from, nil)
+	if err != nil {
+		return err
+	}
+	for _, addr := range to {
+		err = client.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (h SMTPAgent) send(ctx context.Context, config config.Config, identifier string, message Message) (err error) {
+	auth := sasl.NewPlainClient("", config.SMTP.User, config.SMTP.Password)
+	to := []string{identifier}
+	msg, err := composeMessage(config, identifier, message)
+	if err != nil {
+		return err
+	}
+	ctx, span := tracing.Start(ctx, "smtp.send", attribute.String("net.peer.name", config.SMTP.Host))
+	defer func() { tracing.End(span, err) }()
+	return sendMail(ctx, config.SMTP.Host, config.SMTP.Port, auth, config.SMTP.FromAddr, to, msg)
+}
+
+func (h SMTPAgent) Deliver(config config.Config, identifier string, subject string, body string) error {
+	return h.send(context.Background(), config, identifier, Message{Subject: subject, Body: body})
+}
+
+func (h SMTPAgent) DeliverMessage(config config.Config, identifier string, message Message) error {
+	return h.send(context.Background(), config, identifier, message)
+}
+
+func (h SMTPAgent) DeliverContext(ctx context.Context, config config.Config, identifier string, message Message) error {
+	return h.send(ctx, config, identifier, message)
 }
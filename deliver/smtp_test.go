@@ -0,0 +1,158 @@
+package deliver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/mguentner/passwordless/test"
+)
+
+func TestComposeMessageHTML(t *testing.T) {
+	msg, err := composeMessage(test.DefaultConfig(), "bob@example.org", Message{
+		Subject:  "Your token",
+		Body:     "1234",
+		HTMLBody: "<b>1234</b>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Expected multipart/alternative, got %s", mediaType)
+	}
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	expected := []struct {
+		contentType string
+		body        string
+	}{
+		{contentType: "text/plain; charset=utf-8", body: "1234"},
+		{contentType: "text/html; charset=utf-8", body: "<b>1234</b>"},
+	}
+	for _, e := range expected {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Type") != e.contentType {
+			t.Errorf("Expected %s, got %s", e.contentType, part.Header.Get("Content-Type"))
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(body)) != e.body {
+			t.Errorf("Expected %s, got %s", e.body, body)
+		}
+	}
+}
+
+func TestComposeMessageEncodedSubject(t *testing.T) {
+	subject := "Vous avez été invité(e)"
+	msg, err := composeMessage(test.DefaultConfig(), "bob@example.org", Message{Subject: subject + "\r\nBcc: eve@example.com", Body: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Header.Get("Bcc")) > 0 {
+		t.Error("Expected the subject not to add headers")
+	}
+	raw := parsed.Header.Get("Subject")
+	if !strings.HasPrefix(raw, "=?utf-8?q?") {
+		t.Errorf("Expected an RFC 2047 encoded subject, got %s", raw)
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(decoded, subject) {
+		t.Errorf("Expected %s, got %s", subject, decoded)
+	}
+}
+
+type testSMTPBackend struct {
+	messages chan []byte
+}
+
+func (b *testSMTPBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if username != "user" || password != "password" {
+		return nil, errors.New("invalid credentials")
+	}
+	return &testSMTPSession{backend: b}, nil
+}
+
+func (b *testSMTPBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return nil, smtp.ErrAuthRequired
+}
+
+type testSMTPSession struct {
+	backend *testSMTPBackend
+}
+
+func (s *testSMTPSession) Reset()                                        {}
+func (s *testSMTPSession) Logout() error                                 { return nil }
+func (s *testSMTPSession) Mail(from string, opts smtp.MailOptions) error { return nil }
+func (s *testSMTPSession) Rcpt(to string) error                          { return nil }
+
+func (s *testSMTPSession) Data(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.backend.messages <- data
+	return nil
+}
+
+func TestSMTPAgentDeliverContext(t *testing.T) {
+	backend := &testSMTPBackend{messages: make(chan []byte, 1)}
+	server := smtp.NewServer(backend)
+	server.Domain = "localhost"
+	server.AllowInsecureAuth = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	c := test.DefaultConfig()
+	c.SMTP.Host = "127.0.0.1"
+	c.SMTP.Port = uint16(listener.Addr().(*net.TCPAddr).Port)
+	c.SMTP.User = "user"
+	c.SMTP.Password = "password"
+	agent := SMTPAgent{}
+	err = agent.DeliverContext(context.Background(), c, "foo@bar.com", Message{Subject: "subject", Body: "body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := <-backend.messages
+	if !bytes.Contains(message, []byte("To: foo@bar.com")) {
+		t.Errorf("Unexpected message %s", message)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = agent.DeliverContext(ctx, c, "foo@bar.com", Message{Subject: "subject", Body: "body"})
+	if err == nil {
+		t.Error("Expected a cancelled delivery to fail")
+	}
+}
@@ -0,0 +1,144 @@
+package deliver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/tracing"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type WebhookPayload struct {
+	Identifier string `json:"identifier"`
+	Subject    string `json:"subject"`
+	Body       string `json:"body"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+type WebhookError struct {
+	StatusCode int
+}
+
+func (e *WebhookError) Error() string {
+	return fmt.Sprintf("WebhookError: status %d", e.StatusCode)
+}
+
+func (e *WebhookError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// SignWebhookPayload returns the hex encoded HMAC-SHA256 of
+// `<timestamp>.<body>`. Receivers should recompute it and reject stale
+// timestamps to prevent replays.
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookAgent posts the rendered message as JSON to a configured URL,
+// e.g. to forward it to a chat system.
+type WebhookAgent struct {
+}
+
+func postWebhook(ctx context.Context, client *http.Client, webhookConfig config.WebhookConfig, timestamp int64, body []byte, attempt int) (err error) {
+	ctx, span := tracing.Start(ctx, "webhook.post", attribute.Int("webhook.attempt", attempt))
+	defer func() { tracing.End(span, err) }()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookConfig.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Passwordless-Timestamp", strconv.FormatInt(timestamp, 10))
+	if len(webhookConfig.Secret) > 0 {
+		signature := SignWebhookPayload(webhookConfig.Secret, timestamp, body)
+		request.Header.Set("X-Passwordless-Signature", fmt.Sprintf("sha256=%s", signature))
+	}
+	tracing.Inject(ctx, request.Header)
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	span.SetAttributes(attribute.Int("http.status_code", response.StatusCode))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &WebhookError{StatusCode: response.StatusCode}
+	}
+	return nil
+}
+
+func (h WebhookAgent) Deliver(config config.Config, identifier string, subject string, body string) error {
+	return h.DeliverContext(context.Background(), config, identifier, Message{Subject: subject, Body: body})
+}
+
+func (h WebhookAgent) DeliverContext(ctx context.Context, config config.Config, identifier string, message Message) error {
+	webhookConfig := config.Webhook
+	if !webhookConfig.Enabled() {
+		return fmt.Errorf("Webhook delivery is not configured")
+	}
+	timestamp := time.Now().Unix()
+	payload, err := json.Marshal(WebhookPayload{
+		Identifier: identifier,
+		Subject:    message.Subject,
+		Body:       message.Body,
+		Timestamp:  timestamp,
+	})
+	if err != nil {
+		return err
+	}
+	return PostWebhookContext(ctx, webhookConfig, timestamp, payload)
+}
+
+// PostWebhook posts the signed JSON body to the configured URL, failed
+// attempts are retried according to the configuration
+func PostWebhook(webhookConfig config.WebhookConfig, timestamp int64, body []byte) error {
+	return PostWebhookContext(context.Background(), webhookConfig, timestamp, body)
+}
+
+// PostWebhookContext is PostWebhook with every attempt traced as a child of
+// the span in ctx, retries stop once ctx is done
+func PostWebhookContext(ctx context.Context, webhookConfig config.WebhookConfig, timestamp int64, body []byte) error {
+	timeout := time.Second * 10
+	if webhookConfig.TimeoutSeconds > 0 {
+		timeout = time.Second * time.Duration(webhookConfig.TimeoutSeconds)
+	}
+	backoff := time.Millisecond * 500
+	if webhookConfig.RetryBackoffMilliseconds > 0 {
+		backoff = time.Millisecond * time.Duration(webhookConfig.RetryBackoffMilliseconds)
+	}
+	client := &http.Client{Timeout: timeout}
+	for attempt := 0; ; attempt++ {
+		err := postWebhook(ctx, client, webhookConfig, timestamp, body, attempt+1)
+		if err == nil {
+			return nil
+		}
+		if webhookErr, ok := err.(*WebhookError); ok && !webhookErr.retryable() {
+			return err
+		}
+		if attempt >= int(webhookConfig.MaxRetries) {
+			return err
+		}
+		log.Warn().Str("module", "webhook").Msgf("Delivery attempt %d failed, retrying in %v: %v", attempt+1, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,143 @@
+package deliver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/test"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWebhookAgentDeliver(t *testing.T) {
+	attempts := 0
+	var received WebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// Runs outside of the test goroutine, t.Fatal must not be used
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		timestamp, err := strconv.ParseInt(r.Header.Get("X-Passwordless-Timestamp"), 10, 64)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		expected := "sha256=" + SignWebhookPayload("secret", timestamp, body)
+		if r.Header.Get("X-Passwordless-Signature") != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		err = json.Unmarshal(body, &received)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	c := test.DefaultConfig()
+	c.Webhook = config.WebhookConfig{
+		URL:                      server.URL,
+		Secret:                   "secret",
+		MaxRetries:               2,
+		RetryBackoffMilliseconds: 1,
+	}
+	agent := WebhookAgent{}
+	err := agent.Deliver(c, "foo@bar.com", "subject", "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected exactly two attempts, got %d", attempts)
+	}
+	if received.Identifier != "foo@bar.com" || received.Subject != "subject" || received.Body != "body" {
+		t.Errorf("Unexpected payload %+v", received)
+	}
+}
+
+func TestWebhookAgentNoRetryOnClientError(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	c := test.DefaultConfig()
+	c.Webhook = config.WebhookConfig{
+		URL:                      server.URL,
+		MaxRetries:               3,
+		RetryBackoffMilliseconds: 1,
+	}
+	agent := WebhookAgent{}
+	err := agent.Deliver(c, "foo@bar.com", "subject", "body")
+	if _, ok := err.(*WebhookError); !ok {
+		t.Fatalf("Expected a WebhookError, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected exactly one attempt, got %d", attempts)
+	}
+}
+
+func TestWebhookAgentTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	traceparent := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	c := test.DefaultConfig()
+	c.Webhook = config.WebhookConfig{URL: server.URL}
+	c.Routes = []config.RouteConfig{{Agent: "webhook"}}
+	registry := NewRegistry()
+	registry.Register("webhook", &WebhookAgent{})
+	ctx, span := otel.Tracer("test").Start(context.Background(), "login")
+	err := registry.Deliver(ctx, c, "foo@bar.com", Message{Subject: "subject", Body: "body"})
+	span.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	traceID := span.SpanContext().TraceID().String()
+	if header := <-traceparent; !strings.Contains(header, traceID) {
+		t.Errorf("Expected the request to carry trace %s, got %q", traceID, header)
+	}
+	names := map[string]bool{}
+	for _, ended := range recorder.Ended() {
+		if ended.SpanContext().TraceID().String() != traceID {
+			t.Errorf("Expected span %s to be part of the login trace", ended.Name())
+		}
+		names[ended.Name()] = true
+	}
+	for _, name := range []string{"deliver.webhook", "webhook.post"} {
+		if !names[name] {
+			t.Errorf("Expected a %s span, got %v", name, names)
+		}
+	}
+}
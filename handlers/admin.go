@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mguentner/passwordless/audit"
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/identifier"
+	"github.com/mguentner/passwordless/middleware"
+	"github.com/mguentner/passwordless/operations"
+	"github.com/mguentner/passwordless/state"
+	"github.com/rs/zerolog/log"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error().Msgf("Could not marshal: %v", err)
+	}
+}
+
+// adminIdentifier reads and canonicalizes the `identifier` query parameter
+func adminIdentifier(w http.ResponseWriter, r *http.Request, config config.Config) (string, bool) {
+	raw := r.URL.Query().Get("identifier")
+	if len(raw) == 0 {
+		middleware.HttpJSONError(w, "Missing identifier", http.StatusBadRequest)
+		return "", false
+	}
+	id, err := identifier.Canonicalize(config.Identifiers, raw)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Invalid identifier: %v", err), http.StatusBadRequest)
+		return "", false
+	}
+	return id, true
+}
+
+type IdentifierPayload struct {
+	Identifier string `json:"identifier"`
+}
+
+// ListUsersHandler lists the users ordered by identifier. `?q=` filters by
+// a case insensitive substring of the identifier or display name and
+// `?limit=N` limits the number of results.
+func ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	limit := 0
+	if limitParam := query.Get("limit"); len(limitParam) > 0 {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed < 1 {
+			middleware.HttpJSONError(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	users, err := state.AllUsers()
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	search := strings.ToLower(query.Get("q"))
+	matching := users[:0]
+	for _, user := range users {
+		if strings.Contains(strings.ToLower(user.Identifier), search) ||
+			strings.Contains(strings.ToLower(user.DisplayName), search) {
+			matching = append(matching, user)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].Identifier < matching[j].Identifier
+	})
+	if limit > 0 && len(matching) > limit {
+		matching = matching[:limit]
+	}
+	writeJSON(w, http.StatusOK, matching)
+}
+
+// GetUserHandler returns the user with the id in the path
+func GetUserHandler(w http.ResponseWriter, r *http.Request) {
+	s, _, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	user, err := s.UserByID(mux.Vars(r)["id"])
+	if _, ok := err.(*state.NoSuchUser); ok {
+		middleware.HttpJSONError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+// ListTokensHandler lists when the outstanding login tokens of
+// `?identifier=` were created and when they expire, never the tokens
+func ListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	id, ok := adminIdentifier(w, r, *config)
+	if !ok {
+		return
+	}
+	infos, err := state.TokenInfoForIdentifier(id)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+type DeleteTokensResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// DeleteTokensHandler removes the outstanding login tokens of
+// `?identifier=`, this unlocks identifiers that hit maxLoginTokenCount
+func DeleteTokensHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	id, ok := adminIdentifier(w, r, *config)
+	if !ok {
+		return
+	}
+	deleted, err := state.DeleteTokensForIdentifier(id)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("module", "admin").Msgf("Deleted %d login tokens", deleted)
+	writeJSON(w, http.StatusOK, DeleteTokensResponse{Deleted: deleted})
+}
+
+// RevokeSessionsHandler rejects all refresh tokens issued to the identifier
+// so far. Access tokens stay valid until they expire.
+func RevokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	s, config, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	var payload IdentifierPayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Bad payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	id, err := identifier.Canonicalize(config.Identifiers, payload.Identifier)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Invalid identifier: %v", err), http.StatusBadRequest)
+		return
+	}
+	user, err := s.RevokeSessions(id)
+	if _, ok := err.(*state.NoSuchUser); ok {
+		middleware.HttpJSONError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("module", "admin").Msgf("Revoked sessions of user %s", user.ID)
+	audit.Emit(audit.NewEvent(audit.Revocation, id, auditSource(r)))
+	writeJSON(w, http.StatusOK, user)
+}
+
+type TestDeliveryResponse struct {
+	Agents []string `json:"agents"`
+}
+
+// TestDeliveryHandler sends a test message to the identifier, use this to
+// check the delivery configuration
+func TestDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	_, config, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	var payload IdentifierPayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Bad payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	_, err = identifier.DeliveryAddress(payload.Identifier)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Invalid identifier: %v", err), http.StatusBadRequest)
+		return
+	}
+	agents, err := operations.DeliverTestMessage(r.Context(), *config, payload.Identifier)
+	if err != nil {
+		log.Warn().Str("module", "admin").Msgf("Test delivery failed: %v", err)
+		middleware.HttpJSONError(w, fmt.Sprintf("Delivery failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, TestDeliveryResponse{Agents: agents})
+}
+
+// AuditEventsHandler lists the stored audit events, newest first. Filters:
+// `?since=` (RFC 3339), `?type=`, `?identifier=` and `?limit=N`, the
+// limit defaults to 100.
+func AuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	s, config, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	filter := audit.Filter{
+		Type:  audit.EventType(query.Get("type")),
+		Limit: 100,
+	}
+	if since := query.Get("since"); len(since) > 0 {
+		parsed, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			middleware.HttpJSONError(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		filter.Since = parsed
+	}
+	if limitParam := query.Get("limit"); len(limitParam) > 0 {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed < 1 {
+			middleware.HttpJSONError(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = parsed
+	}
+	if len(query.Get("identifier")) > 0 {
+		id, ok := adminIdentifier(w, r, *config)
+		if !ok {
+			return
+		}
+		filter.IdentifierHash = state.EncodeIdentifier(id)
+	}
+	events, err := audit.Query(s, filter)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
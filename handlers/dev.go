@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/mguentner/passwordless/deliver"
+	"github.com/mguentner/passwordless/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+// OutboxHandler lists the last messages of the `outbox` agent, newest
+// first. The number of messages can be limited with `?limit=N`.
+// Only register this in development setups.
+func OutboxHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if limitParam := r.URL.Query().Get("limit"); len(limitParam) > 0 {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed < 1 {
+			middleware.HttpJSONError(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err := encoder.Encode(deliver.DefaultOutbox.Last(limit))
+	if err != nil {
+		log.Error().Msgf("Could not marshal: %v", err)
+		middleware.HttpJSONError(w, "Encoder error", http.StatusInternalServerError)
+		return
+	}
+}
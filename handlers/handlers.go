@@ -1,55 +1,203 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"net/mail"
-	"strings"
+	"sync"
+	"time"
 
+	"github.com/mguentner/passwordless/audit"
 	"github.com/mguentner/passwordless/config"
 	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/deliver"
+	"github.com/mguentner/passwordless/identifier"
+	"github.com/mguentner/passwordless/metrics"
 	"github.com/mguentner/passwordless/middleware"
 	"github.com/mguentner/passwordless/operations"
+	"github.com/mguentner/passwordless/policy"
 	"github.com/mguentner/passwordless/state"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type RequestTokenPayload struct {
 	Email *string `json:"email,omitempty"`
+	// E.164 or any notation NormalizePhoneNumber understands
+	Phone *string `json:"phone,omitempty"`
+	// Optional language tag like `de` or `fr-CH`, the Accept-Language
+	// header is used if this is not set
+	Locale string `json:"locale,omitempty"`
 }
 
-func (p RequestTokenPayload) validate() bool {
-	if p.Email != nil {
-		_, err := mail.ParseAddress(*p.Email)
+// address returns the address of the payload as entered, exactly one of
+// `email` and `phone` must be set
+func (p RequestTokenPayload) address() (string, bool) {
+	if p.Email != nil && p.Phone == nil {
+		_, err := identifier.EmailAddress(*p.Email)
 		if err == nil {
-			return true
+			return *p.Email, true
 		}
 	}
-	return false
+	if p.Phone != nil && p.Email == nil {
+		_, err := identifier.NormalizePhoneNumber(*p.Phone)
+		if err == nil {
+			return *p.Phone, true
+		}
+	}
+	return "", false
 }
 
-func RequestTokenHandler(w http.ResponseWriter, r *http.Request) {
-	state, config, ok := middleware.GetStateAndConfig(w, r)
-	if !ok {
-		return
+type loginError struct {
+	msg    string
+	status int
+	cause  error
+}
+
+func (e *loginError) Error() string {
+	return e.msg
+}
+
+func auditSource(r *http.Request) audit.Source {
+	return audit.Source{
+		IP:        middleware.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: middleware.RequestID(r),
 	}
+}
+
+// loginOutcome is the label of the login_requests_total metric
+func loginOutcome(err error) string {
+	if err == nil {
+		return "delivered"
+	}
+	if policy.IsRejection(err) {
+		return "rejected"
+	}
+	switch err.(type) {
+	case *state.TooManyTokensIssued:
+		return "rate_limited"
+	case *deliver.AllAgentsFailed:
+		return "delivery_failed"
+	}
+	return "error"
+}
 
+// requestToken does the work of RequestTokenHandler, errors carry the
+// status and message for the client
+func requestToken(r *http.Request, state *state.State, config *config.Config) *loginError {
 	var payload RequestTokenPayload
 	jsonDecoder := json.NewDecoder(r.Body)
 	err := jsonDecoder.Decode(&payload)
 	if err != nil {
-		middleware.HttpJSONError(w, fmt.Sprintf("Bad payload: %v", err), http.StatusUnauthorized)
+		metrics.LoginRequests.WithLabelValues("invalid").Inc()
+		return &loginError{msg: fmt.Sprintf("Bad payload: %v", err), status: http.StatusUnauthorized, cause: err}
+	}
+	address, ok := payload.address()
+	if !ok {
+		metrics.LoginRequests.WithLabelValues("invalid").Inc()
+		return &loginError{msg: "Invalid payload", status: http.StatusUnauthorized}
+	}
+	id, err := identifier.Canonicalize(config.Identifiers, address)
+	if err != nil {
+		metrics.LoginRequests.WithLabelValues("invalid").Inc()
+		return &loginError{msg: "Invalid payload", status: http.StatusUnauthorized, cause: err}
+	}
+	locale := operations.ResolveLocale(*config, *state, id, payload.Locale, r.Header.Get("Accept-Language"))
+	metadata := operations.RequestMetadata{
+		IP:        middleware.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Locale:    locale,
+		RequestID: middleware.RequestID(r),
+	}
+	// The message goes to the address as entered, not the canonical form
+	err = operations.GenerateAndStoreAndDeliverTokenForIdentifier(r.Context(), *config, *state, address, metadata)
+	outcome := loginOutcome(err)
+	metrics.LoginRequests.WithLabelValues(outcome).Inc()
+	if outcome == "rate_limited" {
+		metrics.RateLimitRejections.Inc()
+	}
+	if policy.IsRejection(err) {
+		return &loginError{msg: err.Error(), status: http.StatusForbidden, cause: err}
+	}
+	if err != nil {
+		return &loginError{msg: fmt.Sprintf("Could not execute operation: %v", err), status: http.StatusUnauthorized, cause: err}
+	}
+	return nil
+}
+
+// Tracks the logins that are processed after their response was sent,
+// their context is cancelled by WaitForBackgroundWork
+var (
+	backgroundWork                       sync.WaitGroup
+	backgroundRoot, cancelBackgroundWork = context.WithCancel(context.Background())
+)
+
+// WaitForBackgroundWork blocks until all logins accepted in uniform mode
+// have been delivered. If ctx is done first the pending logins are
+// cancelled and still waited for, the state database must not be closed
+// while they use it. Call it after the server stopped accepting requests.
+func WaitForBackgroundWork(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		backgroundWork.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		cancelBackgroundWork()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// uniformRequestToken answers every request with 200 once the configured
+// delay has passed, regardless of the outcome. The token is generated and
+// delivered in the background so that neither errors nor slow delivery can
+// be observed by the client.
+func uniformRequestToken(w http.ResponseWriter, r *http.Request, state *state.State, config *config.Config) {
+	deadline := time.Now().Add(config.UniformLoginResponse.Delay())
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		log.Warn().Msgf("Could not read login request: %v", err)
+	}
+	// Only keep the request id, the client address and the trace, the
+	// request context ends with the response
+	backgroundContext := context.WithValue(backgroundRoot, "requestID", middleware.RequestID(r))
+	backgroundContext = middleware.WithClientIP(backgroundContext, middleware.ClientIP(r))
+	backgroundContext = trace.ContextWithSpanContext(backgroundContext, trace.SpanContextFromContext(r.Context()))
+	backgroundRequest := r.Clone(backgroundContext)
+	backgroundRequest.Body = ioutil.NopCloser(bytes.NewReader(body))
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		loginErr := requestToken(backgroundRequest, state, config)
+		if loginErr != nil {
+			log.Warn().Int("status", loginErr.status).Msgf("Login request failed: %s", loginErr.msg)
+		}
+	}()
+	time.Sleep(time.Until(deadline))
+	w.WriteHeader(http.StatusOK)
+}
+
+func RequestTokenHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
 		return
 	}
-	if !payload.validate() {
-		middleware.HttpJSONError(w, fmt.Sprintf("Invalid payload: %v", err), http.StatusUnauthorized)
+	if config.UniformLoginResponse.Enabled {
+		uniformRequestToken(w, r, state, config)
 		return
 	}
-	remoteAddr := strings.Split(r.RemoteAddr, ":")[0]
-	err = operations.GenerateAndStoreAndDeliverTokenForIdentifier(*config, *state, *payload.Email, remoteAddr)
-	if err != nil {
-		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusUnauthorized)
+	loginErr := requestToken(r, state, config)
+	if loginErr != nil {
+		middleware.HttpJSONError(w, loginErr.msg, loginErr.status)
 		return
 	}
 	w.WriteHeader(200)
@@ -59,6 +207,9 @@ func RequestTokenHandler(w http.ResponseWriter, r *http.Request) {
 type AuthenicatePayload struct {
 	Identifier string `json:"identifier"`
 	Token      string `json:"token"`
+	// Optional language tag that is remembered for future messages, the
+	// Accept-Language header is used if this is not set
+	Locale string `json:"locale,omitempty"`
 }
 
 type AccessRefreshKeysResponse struct {
@@ -66,13 +217,14 @@ type AccessRefreshKeysResponse struct {
 	RefreshToken string `json:"refreshToken"`
 }
 
-func issueAccessAndRefreshTokenForIdentifier(w http.ResponseWriter, config config.Config, state state.State, identifier string) {
-	accessToken, err := crypto.CreateAccessToken(config, state.RSAKeyPairs, identifier)
+func issueAccessAndRefreshToken(w http.ResponseWriter, config config.Config, state state.State, user *state.User) {
+	userInfo := operations.UserInfoForUser(config, *user)
+	accessToken, err := crypto.CreateUserAccessToken(config, state.RSAKeyPairs, user.ID, userInfo)
 	if err != nil {
 		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
 		return
 	}
-	refreshToken, err := crypto.CreateRefreshToken(config, state.RSAKeyPairs, identifier)
+	refreshToken, err := crypto.CreateUserRefreshToken(config, state.RSAKeyPairs, user.ID, user.Identifier, user.SessionGeneration)
 	if err != nil {
 		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
 		return
@@ -102,19 +254,88 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 		middleware.HttpJSONError(w, fmt.Sprintf("Bad payload: %v", err), http.StatusUnauthorized)
 		return
 	}
-	err = operations.InvalidateToken(*state, payload.Identifier, payload.Token)
+	id, err := identifier.Canonicalize(config.Identifiers, payload.Identifier)
+	if err != nil {
+		metrics.ObserveAuthentication(err)
+		audit.Emit(audit.NewEvent(audit.AuthFailure, "", auditSource(r)).WithDetail(err))
+		middleware.HttpJSONError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	err = operations.InvalidateToken(*state, id, payload.Token)
 	if err != nil {
+		metrics.ObserveAuthentication(err)
+		audit.Emit(audit.NewEvent(audit.AuthFailure, id, auditSource(r)).WithDetail(err))
 		middleware.HttpJSONError(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	issueAccessAndRefreshTokenForIdentifier(w, *config, *state, payload.Identifier)
+	user, err := state.RecordLogin(id)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// The identifier is a known user now, the invitation is not needed anymore
+	err = state.DeleteInvitation(id)
+	if err != nil {
+		log.Warn().Msgf("Could not delete invitation: %v", err)
+	}
+	// Only recorded once the client proved to own the identifier, otherwise
+	// anyone could change the language of someone else's messages
+	acceptLanguage := r.Header.Get("Accept-Language")
+	if len(payload.Locale) > 0 || len(acceptLanguage) > 0 {
+		locale := operations.ResolveLocale(*config, *state, id, payload.Locale, acceptLanguage)
+		err = state.SetLocale(id, locale)
+		if err != nil {
+			log.Warn().Msgf("Could not record locale: %v", err)
+		}
+	}
+	metrics.ObserveAuthentication(nil)
+	audit.Emit(audit.NewEvent(audit.AuthSuccess, id, auditSource(r)))
+	issueAccessAndRefreshToken(w, *config, *state, user)
 	return
 }
 
+type SessionRevoked struct{}
+
+func (e *SessionRevoked) Error() string {
+	return "SessionRevoked"
+}
+
+// isNoSuchUser is needed where the state variable shadows the package
+func isNoSuchUser(err error) bool {
+	_, ok := err.(*state.NoSuchUser)
+	return ok
+}
+
+// SubjectMismatch is returned if the user of the identifier is not the
+// subject of the token, e.g. because the user was purged and recreated
+type SubjectMismatch struct{}
+
+func (e *SubjectMismatch) Error() string {
+	return "SubjectMismatch"
+}
+
 type RefreshPayload struct {
 	RefreshToken string `json:"refreshToken"`
 }
 
+// refreshUser looks up the user of a refresh token. Tokens issued before
+// users were introduced carry no subject, their user is created once unless
+// the identifier was purged since. Otherwise the user is never created, a
+// purged user must log in again.
+func refreshUser(s state.State, id string, claims *crypto.DefaultClaims) (*state.User, error) {
+	if len(claims.Subject) > 0 {
+		return s.UserByIdentifier(id)
+	}
+	purged, err := s.WasPurged(id)
+	if err != nil {
+		return nil, err
+	}
+	if purged {
+		return nil, &state.NoSuchUser{}
+	}
+	return s.EnsureUser(id)
+}
+
 func RefreshHandler(w http.ResponseWriter, r *http.Request) {
 	state, config, ok := middleware.GetStateAndConfig(w, r)
 	if !ok {
@@ -130,11 +351,44 @@ func RefreshHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	claims, err := crypto.ValidateRefreshToken(state.RSAKeyPairs, payload.RefreshToken)
 	if err != nil {
+		metrics.ObserveRefresh(err)
+		audit.Emit(audit.NewEvent(audit.AuthFailure, "", auditSource(r)).WithDetail(err))
 		log.Warn().Msgf("Bad token: %s", err.Error())
 		middleware.HttpJSONError(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	issueAccessAndRefreshTokenForIdentifier(w, *config, *state, claims.Identifier)
+	// Tokens issued before canonicalization was introduced carry the
+	// identifier as entered
+	id, err := identifier.Canonicalize(config.Identifiers, claims.Identifier)
+	if err != nil {
+		middleware.HttpJSONError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	user, err := refreshUser(*state, id, claims)
+	if isNoSuchUser(err) {
+		metrics.ObserveRefresh(err)
+		audit.Emit(audit.NewEvent(audit.AuthFailure, id, auditSource(r)).WithDetail(err))
+		middleware.HttpJSONError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(claims.Subject) > 0 && claims.Subject != user.ID {
+		err = &SubjectMismatch{}
+	} else if claims.Session < user.SessionGeneration {
+		err = &SessionRevoked{}
+	}
+	if err != nil {
+		metrics.ObserveRefresh(err)
+		audit.Emit(audit.NewEvent(audit.AuthFailure, id, auditSource(r)).WithDetail(err))
+		middleware.HttpJSONError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	metrics.ObserveRefresh(nil)
+	audit.Emit(audit.NewEvent(audit.Refresh, id, auditSource(r)))
+	issueAccessAndRefreshToken(w, *config, *state, user)
 	return
 }
 
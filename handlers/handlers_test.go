@@ -0,0 +1,589 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/audit"
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/deliver"
+	"github.com/mguentner/passwordless/middleware"
+	"github.com/mguentner/passwordless/state"
+	"github.com/mguentner/passwordless/test"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestState(t *testing.T) *state.State {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &state.State{
+		DB:          db,
+		RSAKeyPairs: crypto.KeyPairForTesting(),
+	}
+}
+
+func withContext(r *http.Request, s *state.State, c config.Config) *http.Request {
+	ctx := context.WithValue(r.Context(), "state", s)
+	ctx = context.WithValue(ctx, "config", config.BasicConfig{Config: c})
+	return r.WithContext(ctx)
+}
+
+func TestRequestTokenHandlerUniformResponse(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{{Agent: "outbox"}}
+	c.UniformLoginResponse = config.UniformResponseConfig{
+		Enabled:           true,
+		DelayMilliseconds: 50,
+	}
+	c.Policy.AllowedDomains = []string{"example.com"}
+	payloads := []string{
+		`{"email":"alice@example.com"}`,
+		`{"email":"alice@blocked.com"}`,
+		`{"email":"not an address"}`,
+		`not json`,
+	}
+	for _, payload := range payloads {
+		start := time.Now()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/api/login", strings.NewReader(payload))
+		RequestTokenHandler(recorder, withContext(request, s, c))
+		elapsed := time.Since(start)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Expected 200 for %s, got %d", payload, recorder.Code)
+		}
+		if recorder.Body.Len() != 0 {
+			t.Errorf("Expected an empty body for %s, got %s", payload, recorder.Body.String())
+		}
+		if elapsed < 50*time.Millisecond {
+			t.Errorf("Expected the response to be delayed for %s, took %v", payload, elapsed)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := WaitForBackgroundWork(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := s.TokensForIdentifier("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 {
+		t.Errorf("Expected 1 token after the background work finished, got %d", len(tokens))
+	}
+}
+
+func TestRequestTokenHandlerErrors(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{{Agent: "outbox"}}
+	c.Policy.AllowedDomains = []string{"example.com"}
+	testSet := []struct {
+		payload  string
+		expected int
+	}{
+		{payload: `{"email":"alice@example.com"}`, expected: http.StatusOK},
+		{payload: `{"email":"alice@blocked.com"}`, expected: http.StatusForbidden},
+		{payload: `{"email":"not an address"}`, expected: http.StatusUnauthorized},
+	}
+	for _, test := range testSet {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/api/login", strings.NewReader(test.payload))
+		RequestTokenHandler(recorder, withContext(request, s, c))
+		if recorder.Code != test.expected {
+			t.Errorf("Expected %d for %s, got %d", test.expected, test.payload, recorder.Code)
+		}
+	}
+}
+
+func TestAuthenticateHandlerClaims(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.AccessTokenLifetimeSeconds = 60
+	c.RefreshTokenLifetimeSeconds = 60
+	c.AccessTokenClaims = map[string]string{
+		"name":       "displayName",
+		"department": "attributes.department",
+	}
+	c.Roles = map[string][]string{
+		"user":  {"profile:read"},
+		"admin": {"admin:*"},
+		"ops":   {"admin:read", "ops:deploy"},
+	}
+	c.DefaultRoles = []string{"user"}
+	c.RoleAssignments = map[string][]string{
+		"alice@example.com": {"admin"},
+	}
+	user, err := s.EnsureUser("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.DisplayName = "Alice"
+	user.Attributes = map[string]string{"department": "ops"}
+	user.Roles = []string{"ops"}
+	_, err = s.UpdateUser(*user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.InsertToken(c, "alice@example.com", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/api/auth", strings.NewReader(`{"identifier":"alice@Example.com","token":"1234"}`))
+	AuthenticateHandler(recorder, withContext(request, s, c))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var response AccessRefreshKeysResponse
+	err = json.NewDecoder(recorder.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := crypto.ValidateAccessToken(s.RSAKeyPairs, response.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != user.ID {
+		t.Errorf("Expected sub %s, got %s", user.ID, claims.Subject)
+	}
+	if claims.Claims["name"] != "Alice" || claims.Claims["department"] != "ops" {
+		t.Errorf("Unexpected claims %v", claims.Claims)
+	}
+	if len(claims.Roles) != 3 || claims.Roles[0] != "user" || claims.Roles[1] != "admin" || claims.Roles[2] != "ops" {
+		t.Errorf("Unexpected roles %v", claims.Roles)
+	}
+	if claims.Scope != "admin:* admin:read ops:deploy profile:read" {
+		t.Errorf("Unexpected scope %q", claims.Scope)
+	}
+	recorded, err := s.UserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded.LastLoginAt == 0 {
+		t.Error("Expected the login to be recorded")
+	}
+}
+
+func TestInviteOnlyRegistration(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{{Agent: "outbox"}}
+	c.Registration.Mode = "invite"
+	login := func(email string) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email":"`+email+`"}`))
+		RequestTokenHandler(recorder, withContext(request, s, c))
+		return recorder.Code
+	}
+	if code := login("bob@example.com"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 without invitation, got %d", code)
+	}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/admin/invitations", strings.NewReader(`{"identifier":"bob@Example.com"}`))
+	CreateInvitationHandler(recorder, withContext(request, s, c))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if code := login("bob@example.com"); code != http.StatusOK {
+		t.Errorf("Expected 200 with invitation, got %d", code)
+	}
+}
+
+func TestInvitationRemovedOnFailedDelivery(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	// Fails because dev.fileDeliveryPath is not set
+	c.Routes = []config.RouteConfig{{Agent: "file"}}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/admin/invitations", strings.NewReader(`{"identifier":"bob@example.com"}`))
+	CreateInvitationHandler(recorder, withContext(request, s, c))
+	if recorder.Code == http.StatusCreated {
+		t.Fatalf("Expected the invitation to fail, got %d", recorder.Code)
+	}
+	_, err := s.InvitationForIdentifier("bob@example.com")
+	if _, ok := err.(*state.NoSuchInvitation); !ok {
+		t.Errorf("Expected no invitation after the failed delivery, got %v", err)
+	}
+}
+
+func TestLocaleRecordedAfterAuthentication(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{{Agent: "outbox"}}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email":"alice@example.com","locale":"de"}`))
+	RequestTokenHandler(recorder, withContext(request, s, c))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	locale, err := s.LocaleForIdentifier("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locale) > 0 {
+		t.Errorf("Expected no locale before authentication, got %s", locale)
+	}
+	err = s.InsertToken(c, "alice@example.com", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("POST", "/api/auth", strings.NewReader(`{"identifier":"alice@example.com","token":"1234"}`))
+	request.Header.Set("Accept-Language", "fr-CH, de;q=0.5")
+	AuthenticateHandler(recorder, withContext(request, s, c))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	locale, err = s.LocaleForIdentifier("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locale != "fr" {
+		t.Errorf("Expected fr after authentication, got %s", locale)
+	}
+}
+
+func TestRefreshAfterRevokedSessions(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.AccessTokenLifetimeSeconds = 60
+	c.RefreshTokenLifetimeSeconds = 60
+	user, err := s.RecordLogin("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken, err := crypto.CreateUserRefreshToken(c, s.RSAKeyPairs, user.ID, user.Identifier, user.SessionGeneration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh := func() int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/api/refresh", strings.NewReader(`{"refreshToken":"`+refreshToken+`"}`))
+		RefreshHandler(recorder, withContext(request, s, c))
+		return recorder.Code
+	}
+	if code := refresh(); code != http.StatusOK {
+		t.Fatalf("Expected 200 before revocation, got %d", code)
+	}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/admin/sessions/revoke", strings.NewReader(`{"identifier":"alice@Example.com"}`))
+	RevokeSessionsHandler(recorder, withContext(request, s, c))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if code := refresh(); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 after revocation, got %d", code)
+	}
+	// A login right after the revocation, usually within the same second,
+	// is not affected
+	err = s.InsertToken(c, "alice@example.com", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("POST", "/api/auth", strings.NewReader(`{"identifier":"alice@example.com","token":"1234"}`))
+	AuthenticateHandler(recorder, withContext(request, s, c))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	response := AccessRefreshKeysResponse{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken = response.RefreshToken
+	if code := refresh(); code != http.StatusOK {
+		t.Errorf("Expected 200 for a token issued after the revocation, got %d", code)
+	}
+}
+
+func TestRefreshAfterPurge(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.AccessTokenLifetimeSeconds = 60
+	c.RefreshTokenLifetimeSeconds = 60
+	user, err := s.RecordLogin("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken, err := crypto.CreateUserRefreshToken(c, s.RSAKeyPairs, user.ID, user.Identifier, user.SessionGeneration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/api/refresh", strings.NewReader(`{"refreshToken":"`+refreshToken+`"}`))
+		RefreshHandler(recorder, withContext(request, s, c))
+		return recorder
+	}
+	_, err = s.PurgeIdentifier("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder := refresh(); recorder.Code != http.StatusUnauthorized || !strings.Contains(recorder.Body.String(), "NoSuchUser") {
+		t.Errorf("Expected 401 NoSuchUser after purge, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	_, err = s.UserByIdentifier("alice@example.com")
+	if _, ok := err.(*state.NoSuchUser); !ok {
+		t.Errorf("Expected the refresh not to recreate the user, got %v", err)
+	}
+	// The identifier registers again and gets a new user id
+	_, err = s.RecordLogin("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder := refresh(); recorder.Code != http.StatusUnauthorized || !strings.Contains(recorder.Body.String(), "SubjectMismatch") {
+		t.Errorf("Expected 401 SubjectMismatch for the new user, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestRefreshLegacyToken(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.AccessTokenLifetimeSeconds = 60
+	c.RefreshTokenLifetimeSeconds = 60
+	// Issued before users were introduced, without subject
+	refreshToken, err := crypto.CreateRefreshToken(c, s.RSAKeyPairs, "alice@Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/api/refresh", strings.NewReader(`{"refreshToken":"`+refreshToken+`"}`))
+		RefreshHandler(recorder, withContext(request, s, c))
+		return recorder
+	}
+	if recorder := refresh(); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a token without subject, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	user, err := s.UserByIdentifier("alice@example.com")
+	if err != nil {
+		t.Fatalf("Expected the user to be created, got %v", err)
+	}
+	if recorder := refresh(); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on the second refresh, got %d", recorder.Code)
+	}
+	again, err := s.UserByIdentifier("alice@example.com")
+	if err != nil || again.ID != user.ID {
+		t.Errorf("Expected the user to be created once, got %v %v", again, err)
+	}
+	_, err = s.RevokeSessions("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder := refresh(); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 after revocation, got %d", recorder.Code)
+	}
+	_, err = s.PurgeIdentifier("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, registered := range []bool{false, true} {
+		if registered {
+			_, err = s.RecordLogin("alice@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if recorder := refresh(); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 after purge (registered again: %v), got %d", registered, recorder.Code)
+		}
+	}
+}
+
+func TestRefreshRevokedSessionAfterPurge(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.AccessTokenLifetimeSeconds = 60
+	c.RefreshTokenLifetimeSeconds = 60
+	user, err := s.RecordLogin("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken, err := crypto.CreateUserRefreshToken(c, s.RSAKeyPairs, user.ID, user.Identifier, user.SessionGeneration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.RevokeSessions("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Purging drops the session generation along with the user
+	_, err = s.PurgeIdentifier("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, registered := range []bool{false, true} {
+		if registered {
+			_, err = s.RecordLogin("alice@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/api/refresh", strings.NewReader(`{"refreshToken":"`+refreshToken+`"}`))
+		RefreshHandler(recorder, withContext(request, s, c))
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("Expected the revoked token to stay rejected (registered again: %v), got %d", registered, recorder.Code)
+		}
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{{Agent: "outbox"}}
+	c.AccessTokenLifetimeSeconds = 60
+	c.RefreshTokenLifetimeSeconds = 60
+	audit.DefaultLogger.SetSinks([]audit.Sink{audit.StateSink{State: s, Retention: time.Hour}})
+	t.Cleanup(func() { audit.DefaultLogger.SetSinks(nil) })
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email":"alice@example.com"}`))
+	request.Header.Set("X-Request-ID", "req-1")
+	middleware.WithRequestIDHandler(http.HandlerFunc(RequestTokenHandler)).ServeHTTP(recorder, withContext(request, s, c))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("POST", "/api/auth", strings.NewReader(`{"identifier":"alice@example.com","token":"wrong"}`))
+	AuthenticateHandler(recorder, withContext(request, s, c))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401, got %d", recorder.Code)
+	}
+
+	events, err := audit.Query(s, audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []audit.EventType{audit.AuthFailure, audit.TokenDelivered, audit.TokenRequested}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), events)
+	}
+	for i, event := range events {
+		if event.Type != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], event.Type)
+		}
+		if event.IdentifierHash != state.EncodeIdentifier("alice@example.com") {
+			t.Errorf("Unexpected identifier hash in %+v", event)
+		}
+	}
+	if events[2].RequestID != "req-1" {
+		t.Errorf("Expected the request id to be recorded, got %s", events[2].RequestID)
+	}
+}
+
+func TestTracingPropagation(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{{Agent: "outbox"}}
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	request := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email":"alice@example.com"}`))
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	response := httptest.NewRecorder()
+	middleware.WithTracingHandler(http.HandlerFunc(RequestTokenHandler)).ServeHTTP(response, withContext(request, s, c))
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", response.Code)
+	}
+	names := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("Expected span %s to continue the incoming trace", span.Name())
+		}
+		names[span.Name()] = true
+	}
+	for _, name := range []string{"POST /api/login", "operations.GenerateAndStoreAndDeliverTokenForIdentifier", "state.InsertToken", "template.render", "deliver.outbox"} {
+		if !names[name] {
+			t.Errorf("Expected a %s span, got %v", name, names)
+		}
+	}
+}
+
+func TestUniformResponseClientIP(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{{Agent: "outbox"}}
+	c.UniformLoginResponse = config.UniformResponseConfig{
+		Enabled:           true,
+		DelayMilliseconds: 10,
+	}
+	c.TrustedProxies = []string{"10.0.0.0/8"}
+	trustedProxies, err := c.TrustedProxyNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.DefaultLogger.SetSinks([]audit.Sink{audit.StateSink{State: s, Retention: time.Hour}})
+	t.Cleanup(func() { audit.DefaultLogger.SetSinks(nil) })
+
+	request := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email":"alice@example.com"}`))
+	request.RemoteAddr = "10.1.2.3:1234"
+	request.Header.Set("X-Forwarded-For", "198.51.100.7")
+	recorder := httptest.NewRecorder()
+	middleware.WithClientIPHandler(trustedProxies, false)(http.HandlerFunc(RequestTokenHandler)).ServeHTTP(recorder, withContext(request, s, c))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = WaitForBackgroundWork(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := audit.Query(s, audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 {
+		t.Fatal("Expected audit events of the background login")
+	}
+	for _, event := range events {
+		if event.IP != "198.51.100.7" {
+			t.Errorf("Expected the forwarded client address in %+v", event)
+		}
+	}
+}
+
+func TestLoginDeliveredToEnteredAddress(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	c.Routes = []config.RouteConfig{{Agent: "outbox"}}
+	c.Identifiers.PlusAddressingDomains = []string{"*"}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email":"\"Bob\" <Bob+ops@Corp.Example>"}`))
+	RequestTokenHandler(recorder, withContext(request, s, c))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	messages := deliver.DefaultOutbox.Last(1)
+	if len(messages) != 1 || messages[0].Identifier != "Bob+ops@corp.example" {
+		t.Errorf("Expected the token to be sent to Bob+ops@corp.example, got %+v", messages)
+	}
+	tokens, err := s.TokensForIdentifier("Bob@corp.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 {
+		t.Errorf("Expected the token to be stored for the canonical identifier, got %d", len(tokens))
+	}
+}
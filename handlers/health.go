@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/mguentner/passwordless/health"
+	"github.com/mguentner/passwordless/middleware"
+)
+
+// HealthHandler reports that the process is alive, it does not check any
+// dependencies so it is suitable for liveness probes
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, health.Report{Status: "ok", Checks: []health.Result{}})
+}
+
+// ReadyHandler runs the readiness checks and responds with 503 if one of
+// them failed, the body lists the result of every check
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	report := health.ReadinessChecker(*config, state).Run(r.Context(), config.Readiness.Timeout())
+	status := http.StatusOK
+	if !report.OK() {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mguentner/passwordless/middleware"
+	"github.com/mguentner/passwordless/operations"
+	"github.com/mguentner/passwordless/policy"
+	"github.com/rs/zerolog/log"
+)
+
+type CreateInvitationPayload struct {
+	Identifier string `json:"identifier"`
+	// Optional language tag of the invitation message
+	Locale string `json:"locale,omitempty"`
+}
+
+// CreateInvitationHandler invites an identifier and sends the invitation
+// message. Responds with 403 if the domain policy rejects the identifier.
+func CreateInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	state, config, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	var payload CreateInvitationPayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Bad payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	invitation, err := operations.CreateInvitation(r.Context(), *config, *state, payload.Identifier, payload.Locale)
+	if err != nil {
+		if policy.IsRejection(err) {
+			middleware.HttpJSONError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		log.Error().Msgf("Could not create invitation: %v", err)
+		middleware.HttpJSONError(w, fmt.Sprintf("Could not create invitation: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(invitation)
+	if err != nil {
+		log.Error().Msgf("Could not marshal: %v", err)
+	}
+}
+
+// ListInvitationsHandler lists all pending invitations
+func ListInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	state, _, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	invitations, err := state.AllInvitations()
+	if err != nil {
+		middleware.HttpJSONError(w, fmt.Sprintf("Could not execute operation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(invitations)
+	if err != nil {
+		log.Error().Msgf("Could not marshal: %v", err)
+		middleware.HttpJSONError(w, "Encoder error", http.StatusInternalServerError)
+		return
+	}
+}
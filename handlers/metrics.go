@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/mguentner/passwordless/metrics"
+	"github.com/mguentner/passwordless/middleware"
+	"github.com/mguentner/passwordless/token"
+)
+
+var metricsHandler = metrics.Handler()
+
+// MetricsHandler serves the Prometheus metrics, requests have to carry
+// `metrics.token` as bearer token if it is set
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	_, config, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	if len(config.Metrics.Token) > 0 {
+		metricsToken, err := middleware.ExtractAuthHeader(r)
+		if err != nil {
+			middleware.HttpJSONError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !token.ConstantTimeCompare(metricsToken, config.Metrics.Token) {
+			middleware.HttpJSONError(w, "InvalidMetricsToken", http.StatusUnauthorized)
+			return
+		}
+	}
+	metricsHandler.ServeHTTP(w, r)
+}
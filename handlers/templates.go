@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mguentner/passwordless/middleware"
+	"github.com/mguentner/passwordless/template"
+	"github.com/rs/zerolog/log"
+)
+
+type TemplatesRenderResponse struct {
+	Rendered []template.Rendered `json:"rendered"`
+	Problems []template.Problem  `json:"problems"`
+}
+
+// TemplatesRenderHandler renders the templates with sample data, optionally
+// filtered by `?lang=` and `?id=`. Responds with 422 if problems were found.
+func TemplatesRenderHandler(w http.ResponseWriter, r *http.Request) {
+	_, config, ok := middleware.GetStateAndConfig(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	rendered, problems, err := template.Render(config.Templates.Path, query.Get("lang"), query.Get("id"))
+	if err != nil {
+		log.Error().Msgf("Could not read templates: %v", err)
+		middleware.HttpJSONError(w, "Could not read templates", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(TemplatesRenderResponse{
+		Rendered: rendered,
+		Problems: problems,
+	})
+	if err != nil {
+		log.Error().Msgf("Could not marshal: %v", err)
+		return
+	}
+}
@@ -0,0 +1,183 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/deliver"
+	"github.com/mguentner/passwordless/state"
+)
+
+type Check func(ctx context.Context) error
+
+type Result struct {
+	Name string `json:"name"`
+	// `ok` or `failed`
+	Status               string `json:"status"`
+	Error                string `json:"error,omitempty"`
+	DurationMilliseconds int64  `json:"durationMs"`
+}
+
+type Report struct {
+	// `ok` if all checks passed, `failed` otherwise
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+func (r Report) OK() bool {
+	return r.Status == "ok"
+}
+
+// Checker runs named checks concurrently
+type Checker struct {
+	checks map[string]Check
+}
+
+func NewChecker() *Checker {
+	return &Checker{checks: map[string]Check{}}
+}
+
+func (c *Checker) Add(name string, check Check) {
+	c.checks[name] = check
+}
+
+type CheckTimeout struct{}
+
+func (e *CheckTimeout) Error() string {
+	return "CheckTimeout"
+}
+
+// Run executes all checks, a check that does not return within timeout is
+// reported as failed. The results are ordered by name.
+func (c *Checker) Run(ctx context.Context, timeout time.Duration) Report {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	report := Report{Status: "ok", Checks: []Result{}}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range c.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() { done <- check(ctx) }()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = &CheckTimeout{}
+			}
+			result := Result{
+				Name:                 name,
+				Status:               "ok",
+				DurationMilliseconds: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				result.Status = "failed"
+				result.Error = err.Error()
+			}
+			mutex.Lock()
+			report.Checks = append(report.Checks, result)
+			if err != nil {
+				report.Status = "failed"
+			}
+			mutex.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	sort.Slice(report.Checks, func(i, j int) bool {
+		return report.Checks[i].Name < report.Checks[j].Name
+	})
+	return report
+}
+
+// StateCheck writes and reads a value in the state database
+func StateCheck(s *state.State) Check {
+	return func(ctx context.Context) error {
+		return s.WithContext(ctx).Probe()
+	}
+}
+
+type NoValidSigningKey struct{}
+
+func (e *NoValidSigningKey) Error() string {
+	return "NoValidSigningKey"
+}
+
+// SigningKeyCheck fails if no key is valid to sign new tokens
+func SigningKeyCheck(s *state.State) Check {
+	return func(ctx context.Context) error {
+		if crypto.GetKeyForTime(s.RSAKeyPairs, time.Now()) == nil {
+			return &NoValidSigningKey{}
+		}
+		return nil
+	}
+}
+
+// cachedCheck remembers the result of a check, concurrent callers wait
+// for the running check and share its result
+type cachedCheck struct {
+	mutex   sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (c *cachedCheck) run(ctx context.Context, check Check, interval time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.checked.IsZero() && time.Since(c.checked) < interval {
+		return c.err
+	}
+	err := check(ctx)
+	// A check aborted by the caller says nothing about the agents
+	if ctx.Err() == nil {
+		c.checked = time.Now()
+		c.err = err
+	}
+	return err
+}
+
+var deliveryProbe cachedCheck
+
+// DeliveryCheck probes the delivery agents in use, e.g. connects to the
+// SMTP server. As /ready can be called by anyone the result is reused for
+// `readiness.probeDeliveryIntervalSeconds`.
+func DeliveryCheck(config config.Config) Check {
+	return func(ctx context.Context) error {
+		return deliveryProbe.run(ctx, probeDelivery(config), config.Readiness.ProbeDeliveryInterval())
+	}
+}
+
+func probeDelivery(config config.Config) Check {
+	return func(ctx context.Context) error {
+		failed := []string{}
+		for name, err := range deliver.DefaultRegistry.Probe(ctx, config) {
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+		if len(failed) > 0 {
+			sort.Strings(failed)
+			return fmt.Errorf("%s", strings.Join(failed, "; "))
+		}
+		return nil
+	}
+}
+
+// ReadinessChecker returns the checks configured for /ready
+func ReadinessChecker(config config.Config, s *state.State) *Checker {
+	checker := NewChecker()
+	checker.Add("state", StateCheck(s))
+	checker.Add("signingKey", SigningKeyCheck(s))
+	if config.Readiness.ProbeDelivery {
+		checker.Add("delivery", DeliveryCheck(config))
+	}
+	return checker
+}
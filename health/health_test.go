@@ -0,0 +1,110 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/state"
+	"github.com/mguentner/passwordless/test"
+)
+
+func newTestState(t *testing.T) *state.State {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &state.State{
+		DB:          db,
+		RSAKeyPairs: crypto.KeyPairForTesting(),
+	}
+}
+
+func resultFor(report Report, name string) Result {
+	for _, result := range report.Checks {
+		if result.Name == name {
+			return result
+		}
+	}
+	return Result{}
+}
+
+func TestReadiness(t *testing.T) {
+	s := newTestState(t)
+	c := test.DefaultConfig()
+	report := ReadinessChecker(c, s).Run(context.Background(), time.Second)
+	if !report.OK() || len(report.Checks) != 2 {
+		t.Fatalf("Expected 2 passing checks, got %+v", report)
+	}
+	s.DB.Close()
+	report = ReadinessChecker(c, s).Run(context.Background(), time.Second)
+	if report.OK() {
+		t.Fatal("Expected a closed database to fail")
+	}
+	if result := resultFor(report, "state"); result.Error != "DatabaseClosed" {
+		t.Errorf("Expected DatabaseClosed, got %+v", result)
+	}
+}
+
+func TestSigningKeyCheck(t *testing.T) {
+	s := &state.State{
+		RSAKeyPairs: []crypto.PublicPrivateRSAKeyPair{
+			{ValidFrom: time.Now().Add(time.Hour).Unix()},
+		},
+	}
+	err := SigningKeyCheck(s)(context.Background())
+	if _, ok := err.(*NoValidSigningKey); !ok {
+		t.Errorf("Expected NoValidSigningKey, got %v", err)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	checker := NewChecker()
+	checker.Add("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	checker.Add("fast", func(ctx context.Context) error {
+		return nil
+	})
+	report := checker.Run(context.Background(), 10*time.Millisecond)
+	if report.OK() {
+		t.Fatal("Expected the slow check to fail")
+	}
+	if result := resultFor(report, "slow"); result.Error != "CheckTimeout" {
+		t.Errorf("Expected CheckTimeout, got %+v", result)
+	}
+	if result := resultFor(report, "fast"); result.Status != "ok" {
+		t.Errorf("Expected the fast check to pass, got %+v", result)
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := func(ctx context.Context) error {
+		calls++
+		return fmt.Errorf("failed %d", calls)
+	}
+	cache := &cachedCheck{}
+	for i := 0; i < 3; i++ {
+		err := cache.run(context.Background(), check, time.Minute)
+		if err == nil || err.Error() != "failed 1" {
+			t.Errorf("Expected the first result to be reused, got %v", err)
+		}
+	}
+	cache.checked = time.Now().Add(-2 * time.Minute)
+	err := cache.run(context.Background(), check, time.Minute)
+	if err == nil || err.Error() != "failed 2" {
+		t.Errorf("Expected the check to run again after the interval, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cache.checked = time.Time{}
+	cache.run(ctx, check, time.Minute)
+	if !cache.checked.IsZero() {
+		t.Error("Expected the result of an aborted check not to be cached")
+	}
+}
@@ -0,0 +1,124 @@
+package identifier
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/mguentner/passwordless/config"
+	"golang.org/x/net/idna"
+)
+
+type InvalidEmailAddress struct{}
+
+func (e *InvalidEmailAddress) Error() string {
+	return "InvalidEmailAddress"
+}
+
+type providerRule struct {
+	// canonical domain, e.g. googlemail.com -> gmail.com
+	domain      string
+	stripDots   bool
+	stripSuffix bool
+}
+
+var providerRules = map[string]providerRule{
+	"gmail.com":      {domain: "gmail.com", stripDots: true, stripSuffix: true},
+	"googlemail.com": {domain: "gmail.com", stripDots: true, stripSuffix: true},
+	"outlook.com":    {domain: "outlook.com", stripSuffix: true},
+	"hotmail.com":    {domain: "hotmail.com", stripSuffix: true},
+	"live.com":       {domain: "live.com", stripSuffix: true},
+	"fastmail.com":   {domain: "fastmail.com", stripSuffix: true},
+	"protonmail.com": {domain: "protonmail.com", stripSuffix: true},
+	"proton.me":      {domain: "proton.me", stripSuffix: true},
+	"icloud.com":     {domain: "icloud.com", stripSuffix: true},
+}
+
+func stripPlusSuffix(localPart string) string {
+	plus := strings.Index(localPart, "+")
+	if plus > 0 {
+		return localPart[:plus]
+	}
+	return localPart
+}
+
+// parseEmail strips the display name of the address and returns the local
+// part as entered and the lower-cased punycode domain
+func parseEmail(address string) (string, string, error) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(address))
+	if err != nil {
+		return "", "", &InvalidEmailAddress{}
+	}
+	at := strings.LastIndex(parsed.Address, "@")
+	if at < 1 {
+		return "", "", &InvalidEmailAddress{}
+	}
+	domain, err := idna.Lookup.ToASCII(parsed.Address[at+1:])
+	if err != nil {
+		return "", "", &InvalidEmailAddress{}
+	}
+	return parsed.Address[:at], strings.ToLower(domain), nil
+}
+
+// EmailAddress returns the address messages are sent to. Only the display
+// name is stripped and the domain converted, so
+// `"Alice" <Alice+news@Bücher.example>` becomes
+// `Alice+news@xn--bcher-kva.example`.
+func EmailAddress(address string) (string, error) {
+	localPart, domain, err := parseEmail(address)
+	if err != nil {
+		return "", err
+	}
+	return localPart + "@" + domain, nil
+}
+
+// CanonicalizeEmail strips the display name of an address like
+// `"Alice" <Alice@Bücher.example>` and returns `Alice@xn--bcher-kva.example`,
+// the identifier config decides which further rules apply. The result is
+// a key for the state and tokens, messages are sent to EmailAddress.
+func CanonicalizeEmail(identifierConfig config.IdentifierConfig, address string) (string, error) {
+	localPart, domain, err := parseEmail(address)
+	if err != nil {
+		return "", err
+	}
+	if identifierConfig.LowercaseLocalPart {
+		localPart = strings.ToLower(localPart)
+	}
+	if identifierConfig.ProviderRules {
+		if rule, ok := providerRules[domain]; ok {
+			domain = rule.domain
+			// None of the providers distinguishes upper and lower case
+			localPart = strings.ToLower(localPart)
+			if rule.stripSuffix {
+				localPart = stripPlusSuffix(localPart)
+			}
+			if rule.stripDots {
+				localPart = strings.ReplaceAll(localPart, ".", "")
+			}
+		}
+	}
+	for _, pattern := range identifierConfig.PlusAddressingDomains {
+		if pattern == "*" || DomainMatches(pattern, domain) {
+			localPart = stripPlusSuffix(localPart)
+			break
+		}
+	}
+	return localPart + "@" + domain, nil
+}
+
+// Canonicalize accepts e-mail addresses and phone numbers in any notation
+// NormalizePhoneNumber understands
+func Canonicalize(identifierConfig config.IdentifierConfig, id string) (string, error) {
+	if phone, err := NormalizePhoneNumber(id); err == nil {
+		return phone, nil
+	}
+	return CanonicalizeEmail(identifierConfig, id)
+}
+
+// DeliveryAddress accepts the same identifiers as Canonicalize and returns
+// the address messages are sent to, see EmailAddress
+func DeliveryAddress(id string) (string, error) {
+	if phone, err := NormalizePhoneNumber(id); err == nil {
+		return phone, nil
+	}
+	return EmailAddress(id)
+}
@@ -0,0 +1,76 @@
+package identifier
+
+import (
+	"testing"
+
+	"github.com/mguentner/passwordless/config"
+)
+
+func TestCanonicalize(t *testing.T) {
+	defaultConfig := config.IdentifierConfig{}
+	providerConfig := config.IdentifierConfig{
+		ProviderRules:         true,
+		PlusAddressingDomains: []string{"*.example.org"},
+	}
+	testSet := []struct {
+		config   config.IdentifierConfig
+		input    string
+		expected string
+		valid    bool
+	}{
+		{config: defaultConfig, input: "alice@example.com", expected: "alice@example.com", valid: true},
+		{config: defaultConfig, input: "Alice@Example.com", expected: "Alice@example.com", valid: true},
+		{config: defaultConfig, input: "\"Alice\" <Alice@EXAMPLE.com>", expected: "Alice@example.com", valid: true},
+		{config: defaultConfig, input: "alice@Bücher.example", expected: "alice@xn--bcher-kva.example", valid: true},
+		{config: defaultConfig, input: "a.lice+tag@gmail.com", expected: "a.lice+tag@gmail.com", valid: true},
+		{config: config.IdentifierConfig{LowercaseLocalPart: true}, input: "Alice@Example.com", expected: "alice@example.com", valid: true},
+		{config: providerConfig, input: "A.Lice+tag@GoogleMail.com", expected: "alice@gmail.com", valid: true},
+		{config: providerConfig, input: "alice+tag@outlook.com", expected: "alice@outlook.com", valid: true},
+		{config: providerConfig, input: "alice+tag@mail.example.org", expected: "alice@mail.example.org", valid: true},
+		{config: providerConfig, input: "alice+tag@example.com", expected: "alice+tag@example.com", valid: true},
+		{config: defaultConfig, input: "+49 170 1234567", expected: "+491701234567", valid: true},
+		{config: defaultConfig, input: "not an address", valid: false},
+		{config: defaultConfig, input: "@example.com", valid: false},
+	}
+	for _, test := range testSet {
+		res, err := Canonicalize(test.config, test.input)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Expected %s to be invalid, got %s", test.input, res)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected %s to be valid: %v", test.input, err)
+			continue
+		}
+		if res != test.expected {
+			t.Errorf("Expected %s for %s but got %s", test.expected, test.input, res)
+		}
+	}
+}
+
+func TestDeliveryAddress(t *testing.T) {
+	testSet := []struct {
+		input    string
+		expected string
+	}{
+		{input: "Bob+ops@Corp.example", expected: "Bob+ops@corp.example"},
+		{input: "\"Alice\" <Alice@Bücher.example>", expected: "Alice@xn--bcher-kva.example"},
+		{input: "A.Lice+tag@GoogleMail.com", expected: "A.Lice+tag@googlemail.com"},
+		{input: "+49 170 1234567", expected: "+491701234567"},
+	}
+	for _, test := range testSet {
+		res, err := DeliveryAddress(test.input)
+		if err != nil {
+			t.Errorf("Expected %s to be valid: %v", test.input, err)
+			continue
+		}
+		if res != test.expected {
+			t.Errorf("Expected %s for %s but got %s", test.expected, test.input, res)
+		}
+	}
+	if _, err := DeliveryAddress("not an address"); err == nil {
+		t.Error("Expected an invalid address to fail")
+	}
+}
@@ -0,0 +1,96 @@
+package identifier
+
+import (
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+type Kind string
+
+const (
+	KindEmail Kind = "email"
+	KindPhone Kind = "phone"
+)
+
+type InvalidPhoneNumber struct{}
+
+func (e *InvalidPhoneNumber) Error() string {
+	return "InvalidPhoneNumber"
+}
+
+// E.164: a leading `+`, a country code that does not start with 0
+// and at most 15 digits in total
+var e164Regex = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// NormalizePhoneNumber turns common notations like `+49 (170) 123-4567`
+// or `0049 170 1234567` into E.164 (`+491701234567`). Numbers without an
+// international prefix are rejected as the country cannot be guessed.
+func NormalizePhoneNumber(number string) (string, error) {
+	var b strings.Builder
+	for i, r := range strings.TrimSpace(number) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '/' || r == '(' || r == ')':
+			continue
+		default:
+			return "", &InvalidPhoneNumber{}
+		}
+	}
+	normalized := b.String()
+	if strings.HasPrefix(normalized, "00") {
+		normalized = "+" + normalized[2:]
+	}
+	if !e164Regex.MatchString(normalized) {
+		return "", &InvalidPhoneNumber{}
+	}
+	return normalized, nil
+}
+
+func IsPhoneNumber(identifier string) bool {
+	return e164Regex.MatchString(identifier)
+}
+
+func IsEmail(identifier string) bool {
+	_, err := mail.ParseAddress(identifier)
+	return err == nil
+}
+
+// KindOf returns the kind of an already normalized identifier
+func KindOf(identifier string) (Kind, error) {
+	if IsPhoneNumber(identifier) {
+		return KindPhone, nil
+	}
+	if IsEmail(identifier) {
+		return KindEmail, nil
+	}
+	return "", errors.New("Unknown identifier format")
+}
+
+// Domain returns the lower-cased domain of an e-mail address or an empty
+// string
+func Domain(identifier string) string {
+	at := strings.LastIndex(identifier, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(identifier[at+1:])
+}
+
+// DomainMatches reports whether domain matches pattern. `*.example.com`
+// matches all subdomains of example.com but not example.com itself
+func DomainMatches(pattern string, domain string) bool {
+	if len(domain) == 0 {
+		return false
+	}
+	domain = strings.ToLower(domain)
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(domain, pattern[1:])
+	}
+	return domain == pattern
+}
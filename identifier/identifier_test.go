@@ -0,0 +1,53 @@
+package identifier
+
+import "testing"
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	testSet := []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{input: "+491701234567", expected: "+491701234567", valid: true},
+		{input: "+49 (170) 123-4567", expected: "+491701234567", valid: true},
+		{input: "0049 170 1234567", expected: "+491701234567", valid: true},
+		{input: " +1 415.555.2671 ", expected: "+14155552671", valid: true},
+		{input: "01701234567", valid: false},
+		{input: "+0123456789", valid: false},
+		{input: "+12", valid: false},
+		{input: "+1234567890123456", valid: false},
+		{input: "+49 170 CALLME", valid: false},
+		{input: "49+1701234567", valid: false},
+	}
+	for _, test := range testSet {
+		res, err := NormalizePhoneNumber(test.input)
+		if test.valid && err != nil {
+			t.Errorf("Expected %s to be valid: %v", test.input, err)
+			continue
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Expected %s to be invalid, got %s", test.input, res)
+			}
+			continue
+		}
+		if res != test.expected {
+			t.Errorf("Expected %s for %s but got %s", test.expected, test.input, res)
+		}
+	}
+}
+
+func TestKindOf(t *testing.T) {
+	kind, err := KindOf("+491701234567")
+	if err != nil || kind != KindPhone {
+		t.Errorf("Expected a phone number, got %s (%v)", kind, err)
+	}
+	kind, err = KindOf("foo@bar.com")
+	if err != nil || kind != KindEmail {
+		t.Errorf("Expected an email address, got %s (%v)", kind, err)
+	}
+	_, err = KindOf("foo")
+	if err == nil {
+		t.Error("Expected an error for an unknown identifier")
+	}
+}
@@ -2,16 +2,29 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mguentner/passwordless/audit"
+	"github.com/mguentner/passwordless/cli"
 	"github.com/mguentner/passwordless/config"
 	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/deliver"
 	"github.com/mguentner/passwordless/handlers"
+	"github.com/mguentner/passwordless/metrics"
 	"github.com/mguentner/passwordless/middleware"
+	"github.com/mguentner/passwordless/operations"
+	"github.com/mguentner/passwordless/policy"
 	"github.com/mguentner/passwordless/state"
-	"github.com/rs/cors"
+	"github.com/mguentner/passwordless/template"
+	"github.com/mguentner/passwordless/tracing"
 	"github.com/rs/zerolog/log"
 	flag "github.com/spf13/pflag"
 )
@@ -22,22 +35,109 @@ var (
 
 // This is a sample application uses all parts of the library
 func main() {
+	if code, ok := cli.Run(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+	os.Exit(serve())
+}
+
+// listen opens `listenSocket` if set, `listenPort` otherwise. A socket
+// left over by a previous run is removed.
+func listen(appConfig config.Config) (net.Listener, error) {
+	if len(appConfig.ListenSocket) == 0 {
+		return net.Listen("tcp", fmt.Sprintf(":%d", appConfig.ListenPort))
+	}
+	info, err := os.Stat(appConfig.ListenSocket)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(appConfig.ListenSocket)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", appConfig.ListenSocket)
+}
+
+// serve runs the server until SIGINT or SIGTERM and returns the exit code.
+// Errors after the state has been opened are returned instead of being
+// fatal so that the database is always closed.
+func serve() (exitCode int) {
 	flag.StringVar(&configPath, "configPath", "config.yaml", "path to the config file")
 	flag.Parse()
 	appConfig, err := config.ReadConfigFromFile(configPath)
 	if err != nil {
 		log.Fatal().Msgf("Could not read config: %v", err)
 	}
+	err = policy.ValidateAllowedAddresses(*appConfig)
+	if err != nil {
+		log.Fatal().Msgf("Invalid policy: %v", err)
+	}
+	err = operations.ValidateRoleAssignments(*appConfig)
+	if err != nil {
+		log.Fatal().Msgf("Invalid roles: %v", err)
+	}
+	trustedProxies, err := appConfig.TrustedProxyNetworks()
+	if err != nil {
+		log.Fatal().Msgf("Invalid trusted proxies: %v", err)
+	}
 	rsaKeys, err := crypto.ReadRSAKeysFromPath(appConfig.KeyPath)
 	if err != nil {
 		log.Fatal().Msgf("Could setup crypto %v", err)
 	}
+	err = deliver.DefaultRegistry.ValidateRoutes(*appConfig)
+	if err != nil {
+		log.Fatal().Msgf("Invalid routes: %v", err)
+	}
+	if appConfig.SMTP.DKIM.Enabled() {
+		_, err = deliver.LoadDKIMSigner(appConfig.SMTP.DKIM.PrivateKeyPath)
+		if err != nil {
+			log.Fatal().Msgf("Could not read DKIM private key: %v", err)
+		}
+	}
+	if len(appConfig.Policy.DisposableDomainsPath) > 0 {
+		_, err = policy.LoadDisposableDomains(appConfig.Policy.DisposableDomainsPath)
+		if err != nil {
+			log.Fatal().Msgf("Could not read disposable domains: %v", err)
+		}
+	}
+	templateStore, err := template.NewStore(appConfig.Templates.Path)
+	if err != nil {
+		log.Fatal().Msgf("Could not load templates: %v", err)
+	}
+	if !templateStore.HasLanguage(appConfig.GetDefaultLocale()) {
+		log.Fatal().Msgf("No templates for the default locale %s", appConfig.GetDefaultLocale())
+	}
+	template.SetDefaultStore(templateStore)
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	if appConfig.Templates.ReloadIntervalSeconds > 0 && len(appConfig.Templates.Path) > 0 {
+		go templateStore.Watch(time.Second*time.Duration(appConfig.Templates.ReloadIntervalSeconds), stopWatching)
+	}
+	shutdownTracing, err := tracing.Setup(appConfig.Tracing, appConfig.ServiceName)
+	if err != nil {
+		log.Fatal().Msgf("Could not setup tracing: %v", err)
+	}
 	state, err := state.NewState(*appConfig, rsaKeys)
 	if err != nil {
 		log.Fatal().Msgf("Could create state: %v", err)
 	}
+	defer func() {
+		err := state.DB.Close()
+		if err != nil {
+			log.Error().Msgf("Could not close state: %v", err)
+			exitCode = 1
+		}
+	}()
+	auditSinks, err := audit.SinksFromConfig(appConfig.Audit, state)
+	if err != nil {
+		log.Error().Msgf("Could not setup audit log: %v", err)
+		return 1
+	}
+	audit.DefaultLogger.SetSinks(auditSinks)
 
 	router := mux.NewRouter()
+	router.Use(middleware.WithRequestIDHandler)
+	router.Use(middleware.WithClientIPHandler(trustedProxies, appConfig.TrustUnixSocketPeer))
+	router.Use(middleware.WithTracingHandler)
 	router.HandleFunc("/api/login", handlers.RequestTokenHandler).Methods("POST")
 	router.HandleFunc("/api/auth", handlers.AuthenticateHandler).Methods("POST")
 	router.HandleFunc("/api/refresh", handlers.RefreshHandler).Methods("POST")
@@ -47,13 +147,39 @@ func main() {
 	protectedRouter.Use(middleware.WithJWTHandler)
 	protectedRouter.HandleFunc("/info", handlers.ClaimsInfoHandler).Methods("GET")
 
-	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
-	router.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
-	corsHandler := cors.AllowAll().Handler(router)
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(middleware.WithAdminTokenHandler)
+	adminRouter.HandleFunc("/templates/render", handlers.TemplatesRenderHandler).Methods("GET")
+	adminRouter.HandleFunc("/invitations", handlers.ListInvitationsHandler).Methods("GET")
+	adminRouter.HandleFunc("/invitations", handlers.CreateInvitationHandler).Methods("POST")
+	adminRouter.HandleFunc("/users", handlers.ListUsersHandler).Methods("GET")
+	adminRouter.HandleFunc("/users/{id}", handlers.GetUserHandler).Methods("GET")
+	adminRouter.HandleFunc("/tokens", handlers.ListTokensHandler).Methods("GET")
+	adminRouter.HandleFunc("/tokens", handlers.DeleteTokensHandler).Methods("DELETE")
+	adminRouter.HandleFunc("/sessions/revoke", handlers.RevokeSessionsHandler).Methods("POST")
+	adminRouter.HandleFunc("/deliveries/test", handlers.TestDeliveryHandler).Methods("POST")
+	adminRouter.HandleFunc("/audit", handlers.AuditEventsHandler).Methods("GET")
+
+	if appConfig.Dev.OutboxSize > 0 {
+		deliver.DefaultOutbox.Resize(appConfig.Dev.OutboxSize)
+	}
+	if appConfig.Dev.OutboxEndpoint {
+		log.Warn().Msg("Serving the development outbox under /dev/outbox, do not use this in production")
+		router.HandleFunc("/dev/outbox", handlers.OutboxHandler).Methods("GET")
+	}
+
+	if appConfig.Metrics.Enabled {
+		err = metrics.RegisterState(state)
+		if err != nil {
+			log.Error().Msgf("Could not register metrics: %v", err)
+			return 1
+		}
+		router.HandleFunc("/metrics", handlers.MetricsHandler).Methods("GET")
+	}
+
+	router.HandleFunc("/health", handlers.HealthHandler).Methods("GET")
+	router.HandleFunc("/ready", handlers.ReadyHandler).Methods("GET")
+	corsHandler := middleware.WithCORSHandler(appConfig.CORS, router)
 	ctxHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := context.WithValue(r.Context(), "state", state)
 		basicConfig := config.BasicConfig{
@@ -62,7 +188,69 @@ func main() {
 		ctx = context.WithValue(ctx, "config", basicConfig)
 		corsHandler.ServeHTTP(w, r.WithContext(ctx))
 	})
-	log.Info().Msgf("Starting to listen on port %d", appConfig.ListenPort)
-	http.ListenAndServe(fmt.Sprintf(":%d", appConfig.ListenPort), ctxHandler)
-	return
+	server := &http.Server{
+		Handler:      ctxHandler,
+		ReadTimeout:  appConfig.Server.ReadTimeout(),
+		WriteTimeout: appConfig.Server.WriteTimeout(),
+		IdleTimeout:  appConfig.Server.IdleTimeout(),
+	}
+	if appConfig.TLS.Enabled() {
+		certificates, err := crypto.NewCertificateStore(appConfig.TLS.CertPath, appConfig.TLS.KeyPath, appConfig.TLS.ClientCAPath)
+		if err != nil {
+			log.Error().Msgf("Could not load certificate: %v", err)
+			return 1
+		}
+		go certificates.Watch(appConfig.TLS.ReloadInterval(), stopWatching)
+		server.TLSConfig = crypto.ServerTLSConfig(appConfig.TLS, certificates)
+	}
+	listener, err := listen(*appConfig)
+	if err != nil {
+		log.Error().Msgf("Could not listen: %v", err)
+		return 1
+	}
+	signalContext, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Info().Msgf("Starting to listen on %s", listener.Addr())
+		if server.TLSConfig != nil {
+			// The certificate is taken from TLSConfig.GetCertificate
+			serverErr <- server.ServeTLS(listener, "", "")
+			return
+		}
+		serverErr <- server.Serve(listener)
+	}()
+	select {
+	case err = <-serverErr:
+		log.Error().Msgf("Server failed: %v", err)
+		exitCode = 1
+	case <-signalContext.Done():
+		log.Info().Msg("Shutting down")
+	}
+	// A second signal kills the process immediately
+	stopSignals()
+
+	shutdownContext, cancel := context.WithTimeout(context.Background(), appConfig.Server.ShutdownTimeout())
+	defer cancel()
+	err = server.Shutdown(shutdownContext)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Msgf("Could not drain requests: %v", err)
+		exitCode = 1
+	}
+	err = handlers.WaitForBackgroundWork(shutdownContext)
+	if err != nil {
+		log.Error().Msgf("Cancelled pending deliveries: %v", err)
+		exitCode = 1
+	}
+	err = audit.DefaultLogger.Close(shutdownContext)
+	if err != nil {
+		log.Error().Msgf("Could not flush audit log: %v", err)
+		exitCode = 1
+	}
+	err = shutdownTracing(shutdownContext)
+	if err != nil {
+		log.Error().Msgf("Could not flush traces: %v", err)
+		exitCode = 1
+	}
+	return exitCode
 }
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/mguentner/passwordless/state"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "passwordless"
+
+var (
+	// Outcome is one of delivered, invalid, rejected, rate_limited,
+	// delivery_failed or error
+	LoginRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_requests_total",
+		Help:      "Login token requests by outcome.",
+	}, []string{"outcome"})
+	DeliveryAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delivery_attempts_total",
+		Help:      "Delivery attempts by agent and result.",
+	}, []string{"agent", "result"})
+	DeliveryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_duration_seconds",
+		Help:      "Duration of delivery attempts by agent.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"agent"})
+	Authentications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authentications_total",
+		Help:      "Login token authentications by result and failure reason.",
+	}, []string{"result", "reason"})
+	Refreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "refreshes_total",
+		Help:      "Refresh token exchanges by result and failure reason.",
+	}, []string{"result", "reason"})
+	RateLimitRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Login requests rejected because maxLoginTokenCount was reached.",
+	})
+)
+
+// Registry holds all metrics of passwordless, it is separate from the
+// prometheus default registry so embedding applications are not affected
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		LoginRequests,
+		DeliveryAttempts,
+		DeliveryDuration,
+		Authentications,
+		Refreshes,
+		RateLimitRejections,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// Reason turns an error into a label value with bounded cardinality: the
+// name of its type like `TokenExpired`, `other` for anonymous errors
+func Reason(err error) string {
+	if err == nil {
+		return ""
+	}
+	t := reflect.TypeOf(err)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if len(t.Name()) == 0 || t.Name() == "errorString" {
+		return "other"
+	}
+	return t.Name()
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func ObserveAuthentication(err error) {
+	Authentications.WithLabelValues(result(err), Reason(err)).Inc()
+}
+
+func ObserveRefresh(err error) {
+	Refreshes.WithLabelValues(result(err), Reason(err)).Inc()
+}
+
+func ObserveDelivery(agent string, start time.Time, err error) {
+	DeliveryDuration.WithLabelValues(agent).Observe(time.Since(start).Seconds())
+	DeliveryAttempts.WithLabelValues(agent, result(err)).Inc()
+}
+
+// signingKeyAge returns the age of the key used to sign new tokens
+func signingKeyAge(s *state.State) float64 {
+	now := time.Now().Unix()
+	newest := int64(-1)
+	for _, keyPair := range s.RSAKeyPairs {
+		if keyPair.ValidFrom < now && keyPair.ValidFrom > newest {
+			newest = keyPair.ValidFrom
+		}
+	}
+	if newest < 0 {
+		return 0
+	}
+	return float64(now - newest)
+}
+
+// RegisterState adds gauges for the active signing key and the size of the
+// state database
+func RegisterState(s *state.State) error {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "signing_key_age_seconds",
+			Help:      "Age of the key used to sign new tokens.",
+		}, func() float64 {
+			return signingKeyAge(s)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "badger_lsm_size_bytes",
+			Help:      "Size of the LSM tree of the state database.",
+		}, func() float64 {
+			lsm, _ := s.DB.Size()
+			return float64(lsm)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "badger_vlog_size_bytes",
+			Help:      "Size of the value log of the state database.",
+		}, func() float64 {
+			_, vlog := s.DB.Size()
+			return float64(vlog)
+		}),
+	}
+	for _, collector := range collectors {
+		err := Registry.Register(collector)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/state"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReason(t *testing.T) {
+	testSet := []struct {
+		err      error
+		expected string
+	}{
+		{err: nil, expected: ""},
+		{err: &crypto.TokenExpired{}, expected: "TokenExpired"},
+		{err: &state.NoSuchIdentifierTokenPair{}, expected: "NoSuchIdentifierTokenPair"},
+		{err: errors.New("dynamic text"), expected: "other"},
+	}
+	for _, test := range testSet {
+		if reason := Reason(test.err); reason != test.expected {
+			t.Errorf("Expected %s for %v, got %s", test.expected, test.err, reason)
+		}
+	}
+}
+
+func TestObserve(t *testing.T) {
+	ObserveAuthentication(&crypto.TokenExpired{})
+	ObserveAuthentication(nil)
+	if count := testutil.ToFloat64(Authentications.WithLabelValues("failure", "TokenExpired")); count != 1 {
+		t.Errorf("Expected 1 failure, got %f", count)
+	}
+	if count := testutil.ToFloat64(Authentications.WithLabelValues("success", "")); count != 1 {
+		t.Errorf("Expected 1 success, got %f", count)
+	}
+	ObserveDelivery("outbox", time.Now(), nil)
+	if count := testutil.ToFloat64(DeliveryAttempts.WithLabelValues("outbox", "success")); count != 1 {
+		t.Errorf("Expected 1 delivery, got %f", count)
+	}
+}
+
+func TestSigningKeyAge(t *testing.T) {
+	now := time.Now().Unix()
+	s := &state.State{
+		RSAKeyPairs: []crypto.PublicPrivateRSAKeyPair{
+			{ValidFrom: now - 3600},
+			{ValidFrom: now - 60},
+			{ValidFrom: now + 3600},
+		},
+	}
+	age := signingKeyAge(s)
+	if age < 60 || age > 62 {
+		t.Errorf("Expected the newest valid key to be used, got age %f", age)
+	}
+}
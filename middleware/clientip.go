@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseAddress accepts an IP with an optional port, IPv6 addresses with a
+// port have to be enclosed in brackets
+func parseAddress(address string) net.IP {
+	address = strings.Trim(strings.TrimSpace(address), `"`)
+	if ip := net.ParseIP(strings.Trim(address, "[]")); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedFor returns the `for` addresses of the Forwarded headers, or of
+// X-Forwarded-For if there is no Forwarded header, in the order the
+// proxies added them. Unparsable entries like `unknown` are nil.
+func forwardedFor(r *http.Request) []net.IP {
+	addresses := []net.IP{}
+	forwarded := r.Header.Values("Forwarded")
+	if len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			var ip net.IP
+			for _, pair := range strings.Split(element, ";") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) == 2 && strings.EqualFold(parts[0], "for") {
+					ip = parseAddress(parts[1])
+				}
+			}
+			addresses = append(addresses, ip)
+		}
+		return addresses
+	}
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(value, ",") {
+			addresses = append(addresses, parseAddress(address))
+		}
+	}
+	return addresses
+}
+
+func isTrusted(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromUnixSocket reports whether the request was accepted on a Unix
+// socket, RemoteAddr carries no address in this case
+func fromUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+// clientIP returns the address of the client. Forwarded and
+// X-Forwarded-For are only honoured if the peer is one of trustedProxies
+// or, with trustUnixSocketPeer, connected through a Unix socket. The chain
+// is then followed from the right up to the first address that is not a
+// trusted proxy.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet, trustUnixSocketPeer bool) string {
+	client := r.RemoteAddr
+	peer := parseAddress(r.RemoteAddr)
+	if peer != nil {
+		client = peer.String()
+	}
+	if fromUnixSocket(r) {
+		if !trustUnixSocketPeer {
+			return client
+		}
+	} else if peer == nil || !isTrusted(peer, trustedProxies) {
+		return client
+	}
+	addresses := forwardedFor(r)
+	for i := len(addresses) - 1; i >= 0; i-- {
+		if addresses[i] == nil {
+			// The proxy that added this entry is the last address known
+			break
+		}
+		client = addresses[i].String()
+		if !isTrusted(addresses[i], trustedProxies) {
+			break
+		}
+	}
+	return client
+}
+
+// WithClientIPHandler determines the client address of each request, pass
+// the networks of Config.TrustedProxyNetworks parsed once at startup and
+// `trustUnixSocketPeer`
+func WithClientIPHandler(trustedProxies []*net.IPNet, trustUnixSocketPeer bool) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r, trustedProxies, trustUnixSocketPeer)
+			h.ServeHTTP(w, r.WithContext(WithClientIP(r.Context(), ip)))
+		})
+	}
+}
+
+// WithClientIP stores the client address in ctx, use it to keep the
+// address when work outlives the request context
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, "clientIP", ip)
+}
+
+// ClientIP returns the address set by WithClientIPHandler, without the
+// handler it is the address of the peer
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value("clientIP").(string); ok {
+		return ip
+	}
+	return clientIP(r, nil, false)
+}
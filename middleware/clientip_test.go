@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mguentner/passwordless/config"
+)
+
+func TestClientIP(t *testing.T) {
+	c := config.Config{
+		TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"},
+	}
+	trustedProxies, err := c.TrustedProxyNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ip string
+	handler := WithClientIPHandler(trustedProxies, false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip = ClientIP(r)
+	}))
+	testSet := []struct {
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{remoteAddr: "192.0.2.1:1234", expected: "192.0.2.1"},
+		{remoteAddr: "[2001:db8::17]:1234", expected: "2001:db8::17"},
+		// Headers of untrusted peers are ignored
+		{remoteAddr: "192.0.2.1:1234", headers: map[string]string{"X-Forwarded-For": "198.51.100.7"}, expected: "192.0.2.1"},
+		{remoteAddr: "10.1.2.3:1234", headers: map[string]string{"X-Forwarded-For": "198.51.100.7"}, expected: "198.51.100.7"},
+		// Spoofed entries left of the first untrusted address are ignored
+		{remoteAddr: "10.1.2.3:1234", headers: map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7, 10.4.5.6"}, expected: "198.51.100.7"},
+		{remoteAddr: "[2001:db8::1]:1234", headers: map[string]string{"X-Forwarded-For": "2001:db8:cafe::17"}, expected: "2001:db8:cafe::17"},
+		{remoteAddr: "10.1.2.3:1234", headers: map[string]string{"Forwarded": `for=198.51.100.7;proto=https, for="[2001:db8:cafe::17]:4711"`}, expected: "2001:db8:cafe::17"},
+		// Forwarded takes precedence over X-Forwarded-For
+		{remoteAddr: "10.1.2.3:1234", headers: map[string]string{"Forwarded": "for=198.51.100.7", "X-Forwarded-For": "203.0.113.9"}, expected: "198.51.100.7"},
+		{remoteAddr: "10.1.2.3:1234", headers: map[string]string{"Forwarded": "for=unknown"}, expected: "10.1.2.3"},
+		{remoteAddr: "10.1.2.3:1234", headers: map[string]string{"X-Forwarded-For": "10.4.5.6"}, expected: "10.4.5.6"},
+	}
+	for _, testCase := range testSet {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = testCase.remoteAddr
+		for name, value := range testCase.headers {
+			request.Header.Set(name, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+		if ip != testCase.expected {
+			t.Errorf("Expected %s for %s %v, got %s", testCase.expected, testCase.remoteAddr, testCase.headers, ip)
+		}
+	}
+}
+
+func TestClientIPUnixSocket(t *testing.T) {
+	testSet := []struct {
+		trustUnixSocketPeer bool
+		forwardedFor        string
+		expected            string
+	}{
+		{trustUnixSocketPeer: false, forwardedFor: "198.51.100.7", expected: "@"},
+		{trustUnixSocketPeer: true, forwardedFor: "198.51.100.7", expected: "198.51.100.7"},
+		{trustUnixSocketPeer: true, forwardedFor: "203.0.113.9, 198.51.100.7", expected: "198.51.100.7"},
+		{trustUnixSocketPeer: true, expected: "@"},
+	}
+	for _, testCase := range testSet {
+		var ip string
+		handler := WithClientIPHandler(nil, testCase.trustUnixSocketPeer)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip = ClientIP(r)
+		}))
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = "@"
+		if len(testCase.forwardedFor) > 0 {
+			request.Header.Set("X-Forwarded-For", testCase.forwardedFor)
+		}
+		ctx := context.WithValue(request.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/passwordless.sock", Net: "unix"})
+		handler.ServeHTTP(httptest.NewRecorder(), request.WithContext(ctx))
+		if ip != testCase.expected {
+			t.Errorf("Expected %s for %+v, got %s", testCase.expected, testCase, ip)
+		}
+	}
+}
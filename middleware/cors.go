@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/rs/cors"
+)
+
+// withCORSPolicy wraps h according to the policy. Without allowed origins
+// no CORS headers are sent at all, cors.New would allow every origin.
+func withCORSPolicy(policy config.CORSPolicy, h http.Handler) http.Handler {
+	if len(policy.AllowedOrigins) == 0 {
+		return h
+	}
+	return cors.New(cors.Options{
+		AllowedOrigins:   policy.AllowedOrigins,
+		AllowedMethods:   []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete},
+		AllowedHeaders:   policy.GetAllowedHeaders(),
+		ExposedHeaders:   []string{"X-Request-ID"},
+		AllowCredentials: policy.AllowCredentials,
+		MaxAge:           policy.MaxAgeSeconds,
+	}).Handler(h)
+}
+
+// WithCORSHandler applies `cors.admin` to the /admin routes and `cors.api`
+// to all others. It has to wrap the router, preflight requests do not
+// match any route.
+func WithCORSHandler(corsConfig config.CORSConfig, h http.Handler) http.Handler {
+	api := withCORSPolicy(corsConfig.API, h)
+	admin := withCORSPolicy(corsConfig.Admin, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/") {
+			admin.ServeHTTP(w, r)
+			return
+		}
+		api.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mguentner/passwordless/config"
+)
+
+func TestWithCORSHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := WithCORSHandler(config.CORSConfig{
+		API: config.CORSPolicy{
+			AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+			AllowCredentials: true,
+			MaxAgeSeconds:    600,
+		},
+	}, ok)
+	testSet := []struct {
+		path     string
+		origin   string
+		expected string
+	}{
+		{path: "/api/auth", origin: "https://app.example.com", expected: "https://app.example.com"},
+		{path: "/api/refresh", origin: "https://shop.example.org", expected: "https://shop.example.org"},
+		{path: "/api/auth", origin: "https://evil.com", expected: ""},
+		{path: "/api/auth", origin: "https://example.org.evil.com", expected: ""},
+		// Admin routes have their own, empty policy
+		{path: "/admin/users", origin: "https://app.example.com", expected: ""},
+	}
+	for _, testCase := range testSet {
+		request := httptest.NewRequest("OPTIONS", testCase.path, nil)
+		request.Header.Set("Origin", testCase.origin)
+		request.Header.Set("Access-Control-Request-Method", "POST")
+		request.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		allowed := recorder.Header().Get("Access-Control-Allow-Origin")
+		if allowed != testCase.expected {
+			t.Errorf("Expected %q for %s from %s, got %q", testCase.expected, testCase.path, testCase.origin, allowed)
+		}
+		if len(testCase.expected) > 0 {
+			if recorder.Header().Get("Access-Control-Allow-Credentials") != "true" {
+				t.Errorf("Expected credentials to be allowed for %s", testCase.origin)
+			}
+			if recorder.Header().Get("Access-Control-Max-Age") != "600" {
+				t.Errorf("Expected a max age for %s", testCase.origin)
+			}
+		}
+	}
+}
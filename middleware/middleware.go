@@ -3,12 +3,14 @@ package middleware
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/mguentner/passwordless/config"
 	"github.com/mguentner/passwordless/crypto"
 	"github.com/mguentner/passwordless/state"
+	"github.com/mguentner/passwordless/token"
 	"github.com/rs/zerolog/log"
 )
 
@@ -24,7 +26,7 @@ func GetStateAndConfig(w http.ResponseWriter, r *http.Request) (*state.State, *c
 		return nil, nil, false
 	}
 	config := configurable.GetConfig()
-	return state, config, true
+	return state.WithContext(r.Context()), config, true
 }
 
 func HttpJSONError(w http.ResponseWriter, msg string, code int) {
@@ -94,6 +96,49 @@ func WithJWTAuthorization(w http.ResponseWriter, r *http.Request) *http.Request
 	return requestWithClaims
 }
 
+type InvalidAdminToken struct{}
+
+func (e *InvalidAdminToken) Error() string {
+	return "InvalidAdminToken"
+}
+
+type ClientCertificateRequired struct{}
+
+func (e *ClientCertificateRequired) Error() string {
+	return "ClientCertificateRequired"
+}
+
+// WithAdminTokenHandler only passes requests carrying `admin.token` as
+// bearer token. If `tls.clientCAPath` is set, a verified client certificate
+// is required as well.
+func WithAdminTokenHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, config, ok := GetStateAndConfig(w, r)
+		if !ok {
+			HttpJSONError(w, "Configuration Error", http.StatusInternalServerError)
+			return
+		}
+		if !config.Admin.Enabled() {
+			HttpJSONError(w, "Admin API disabled", http.StatusNotFound)
+			return
+		}
+		if len(config.TLS.ClientCAPath) > 0 && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			HttpJSONError(w, (&ClientCertificateRequired{}).Error(), http.StatusUnauthorized)
+			return
+		}
+		adminToken, err := ExtractAuthHeader(r)
+		if err != nil {
+			HttpJSONError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !token.ConstantTimeCompare(adminToken, config.Admin.Token) {
+			HttpJSONError(w, (&InvalidAdminToken{}).Error(), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func WithJWTHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		newRequest := WithJWTAuthorization(w, r)
@@ -103,3 +148,62 @@ func WithJWTHandler(h http.Handler) http.Handler {
 		h.ServeHTTP(w, newRequest)
 	})
 }
+
+type InsufficientScope struct {
+	Scope string
+}
+
+func (e *InsufficientScope) Error() string {
+	return fmt.Sprintf("InsufficientScope: %s required", e.Scope)
+}
+
+type MissingRole struct {
+	Role string
+}
+
+func (e *MissingRole) Error() string {
+	return fmt.Sprintf("MissingRole: %s required", e.Role)
+}
+
+func claimsFromContext(r *http.Request) (*crypto.DefaultClaims, bool) {
+	claims, ok := r.Context().Value("accessToken").(*crypto.DefaultClaims)
+	return claims, ok && claims != nil
+}
+
+// RequireScope only passes requests whose access token grants scope, it
+// needs to be used after WithJWTHandler
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := claimsFromContext(r)
+			if !ok {
+				HttpJSONError(w, "No accessToken found", http.StatusUnauthorized)
+				return
+			}
+			if !claims.HasScope(scope) {
+				HttpJSONError(w, (&InsufficientScope{Scope: scope}).Error(), http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRole only passes requests whose access token carries role, it
+// needs to be used after WithJWTHandler
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := claimsFromContext(r)
+			if !ok {
+				HttpJSONError(w, "No accessToken found", http.StatusUnauthorized)
+				return
+			}
+			if !claims.HasRole(role) {
+				HttpJSONError(w, (&MissingRole{Role: role}).Error(), http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/state"
+)
+
+func withClaims(r *http.Request, claims *crypto.DefaultClaims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), "accessToken", claims))
+}
+
+func TestRequireScope(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := RequireScope("admin:read")(ok)
+	testSet := []struct {
+		scope    string
+		expected int
+	}{
+		{scope: "admin:read", expected: http.StatusOK},
+		{scope: "profile:read admin:read", expected: http.StatusOK},
+		{scope: "admin:*", expected: http.StatusOK},
+		{scope: "*", expected: http.StatusOK},
+		{scope: "admin:write", expected: http.StatusForbidden},
+		{scope: "admin", expected: http.StatusForbidden},
+		{scope: "", expected: http.StatusForbidden},
+	}
+	for _, test := range testSet {
+		claims := &crypto.DefaultClaims{
+			UserInfo: crypto.UserInfo{Scope: test.scope},
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, withClaims(httptest.NewRequest("GET", "/", nil), claims))
+		if recorder.Code != test.expected {
+			t.Errorf("Expected %d for scope %q, got %d", test.expected, test.scope, recorder.Code)
+		}
+		if test.expected == http.StatusForbidden {
+			var body map[string]string
+			err := json.NewDecoder(recorder.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body["msg"] != "InsufficientScope: admin:read required" {
+				t.Errorf("Unexpected error message %q", body["msg"])
+			}
+		}
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without claims, got %d", recorder.Code)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := RequireRole("admin")(ok)
+	recorder := httptest.NewRecorder()
+	claims := &crypto.DefaultClaims{UserInfo: crypto.UserInfo{Roles: []string{"user", "admin"}}}
+	handler.ServeHTTP(recorder, withClaims(httptest.NewRequest("GET", "/", nil), claims))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	claims = &crypto.DefaultClaims{UserInfo: crypto.UserInfo{Roles: []string{"user"}}}
+	handler.ServeHTTP(recorder, withClaims(httptest.NewRequest("GET", "/", nil), claims))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", recorder.Code)
+	}
+}
+
+func TestWithAdminTokenHandlerClientCertificate(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := WithAdminTokenHandler(ok)
+	c := config.Config{
+		Admin: config.AdminConfig{Token: "secret"},
+		TLS:   config.TLSConfig{CertPath: "cert.pem", KeyPath: "key.pem", ClientCAPath: "ca.pem"},
+	}
+	testSet := []struct {
+		state    *tls.ConnectionState
+		expected int
+	}{
+		{state: nil, expected: http.StatusUnauthorized},
+		// A certificate was sent but could not be verified
+		{state: &tls.ConnectionState{}, expected: http.StatusUnauthorized},
+		{state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{&x509.Certificate{}}}}, expected: http.StatusOK},
+	}
+	for _, testCase := range testSet {
+		request := httptest.NewRequest("GET", "/admin/users", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		request.TLS = testCase.state
+		ctx := context.WithValue(request.Context(), "state", &state.State{})
+		ctx = context.WithValue(ctx, "config", config.BasicConfig{Config: c})
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request.WithContext(ctx))
+		if recorder.Code != testCase.expected {
+			t.Errorf("Expected %d for %+v, got %d", testCase.expected, testCase.state, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const maxRequestIDLength = 128
+
+func newRequestID() string {
+	id := make([]byte, 12)
+	_, err := rand.Read(id)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// WithRequestIDHandler keeps the X-Request-ID header of the request or
+// generates a new id, the id is echoed in the response
+func WithRequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if len(requestID) == 0 || len(requestID) > maxRequestIDLength {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "requestID", requestID)))
+	})
+}
+
+// RequestID returns the id set by WithRequestIDHandler or an empty string
+func RequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value("requestID").(string)
+	return requestID
+}
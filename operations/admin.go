@@ -0,0 +1,29 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/deliver"
+	"github.com/mguentner/passwordless/identifier"
+)
+
+// DeliverTestMessage sends a message without a token to the delivery
+// address of the identifier using the configured routes. Returns the
+// agents the message was routed to, the primary agent first.
+func DeliverTestMessage(ctx context.Context, config config.Config, id string) ([]string, error) {
+	to, err := identifier.DeliveryAddress(id)
+	if err != nil {
+		return nil, err
+	}
+	agents, err := deliver.DefaultRegistry.Route(config, to)
+	if err != nil {
+		return nil, err
+	}
+	message := deliver.Message{
+		Subject: fmt.Sprintf("[%s] - Test message", config.ServiceName),
+		Body:    fmt.Sprintf("This is a test message from %s, no action is required.", config.ServiceName),
+	}
+	return agents, deliver.DefaultRegistry.Deliver(ctx, config, to, message)
+}
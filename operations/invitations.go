@@ -0,0 +1,98 @@
+package operations
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/deliver"
+	"github.com/mguentner/passwordless/identifier"
+	"github.com/mguentner/passwordless/policy"
+	"github.com/mguentner/passwordless/state"
+	"github.com/mguentner/passwordless/template"
+	"github.com/rs/zerolog/log"
+)
+
+var invitationTemplates = messageTemplates{
+	Body:    "invitation",
+	Subject: "invitation-subject",
+	HTML:    "invitation-html",
+	SMS:     "invitation-sms",
+}
+
+func invitationURL(config config.Config, id string) (string, error) {
+	if len(config.Registration.InvitationURL) == 0 {
+		return "", nil
+	}
+	parsed, err := url.Parse(config.Registration.InvitationURL)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	query.Set("identifier", id)
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// CreateInvitation stores an invitation for the canonical identifier and
+// notifies the address as entered. The domain policy applies to
+// invitations as well. If the message cannot be delivered the invitation
+// is removed again.
+func CreateInvitation(ctx context.Context, config config.Config, state state.State, id string, locale string) (*state.Invitation, error) {
+	to, err := identifier.DeliveryAddress(id)
+	if err != nil {
+		return nil, err
+	}
+	id, err = identifier.Canonicalize(config.Identifiers, id)
+	if err != nil {
+		return nil, err
+	}
+	kind, err := identifier.KindOf(id)
+	if err != nil {
+		return nil, err
+	}
+	err = policy.Check(config, id)
+	if err != nil {
+		return nil, err
+	}
+	location, err := config.Templates.Location()
+	if err != nil {
+		return nil, err
+	}
+	link, err := invitationURL(config, id)
+	if err != nil {
+		return nil, err
+	}
+	lifetime := config.Registration.InvitationLifetime()
+	invitation, err := state.InsertInvitation(id, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	lang := ResolveLocale(config, state, id, locale, "")
+	templateData := template.TemplateData{
+		Service:          config.ServiceName,
+		Lang:             lang,
+		RequestTime:      time.Unix(invitation.CreatedAt, 0).In(location),
+		ExpiresAt:        time.Unix(invitation.ExpiresAt, 0).In(location),
+		ExpiresInMinutes: uint64((lifetime + time.Minute - 1) / time.Minute),
+		SupportURL:       config.SupportURL,
+		LoginURL:         link,
+	}
+	message, err := renderMessage(ctx, config, kind, lang, invitationTemplates, templateData)
+	if err == nil {
+		err = deliver.DefaultRegistry.Deliver(ctx, config, to, message)
+	}
+	if err != nil {
+		deleteErr := state.DeleteInvitation(id)
+		if deleteErr != nil {
+			log.Error().Msgf("Could not delete undelivered invitation: %v", deleteErr)
+		}
+		return nil, err
+	}
+	err = state.SetLocale(id, lang)
+	if err != nil {
+		log.Warn().Msgf("Could not record locale: %v", err)
+	}
+	return invitation, nil
+}
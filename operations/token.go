@@ -1,43 +1,217 @@
 package operations
 
 import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/mguentner/passwordless/audit"
 	"github.com/mguentner/passwordless/config"
 	"github.com/mguentner/passwordless/deliver"
+	"github.com/mguentner/passwordless/identifier"
+	"github.com/mguentner/passwordless/policy"
 	"github.com/mguentner/passwordless/state"
 	"github.com/mguentner/passwordless/template"
 	"github.com/mguentner/passwordless/token"
+	"github.com/mguentner/passwordless/tracing"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func GenerateAndStoreAndDeliverTokenForIdentifier(config config.Config, state state.State, identifier string, requestingIP string) error {
-	token, err := token.Generate(config)
+// ResolveLocale picks the template language for the identifier. In order of
+// precedence: the explicitly requested locale, the Accept-Language header,
+// the locale recorded for the identifier and finally the default locale.
+func ResolveLocale(config config.Config, state state.State, id string, requested string, acceptLanguage string) string {
+	recorded, err := state.LocaleForIdentifier(id)
+	if err != nil {
+		log.Warn().Msgf("Could not read locale: %v", err)
+	}
+	available := template.DefaultStore.Languages()
+	lang, ok := template.NegotiateLanguage(available, requested, acceptLanguage, recorded)
+	if !ok {
+		return config.GetDefaultLocale()
+	}
+	return lang
+}
+
+// LocaleForIdentifier returns the locale the last message to the identifier
+// was sent in, use this for follow-up messages
+func LocaleForIdentifier(config config.Config, state state.State, id string) string {
+	return ResolveLocale(config, state, id, "", "")
+}
+
+// evaluateTemplate falls back to the default locale if the template does not
+// exist for lang
+func evaluateTemplate(config config.Config, lang string, templateID string, data template.TemplateData) (string, error) {
+	if !template.DefaultStore.Has(lang, templateID) {
+		lang = config.GetDefaultLocale()
+	}
+	return template.EvaluateTemplate(lang, templateID, data)
+}
+
+// messageTemplates names the templates a message is rendered from
+type messageTemplates struct {
+	Body    string
+	Subject string
+	HTML    string
+	SMS     string
+}
+
+var loginTemplates = messageTemplates{
+	Body:    "email",
+	Subject: "email-subject",
+	HTML:    "email-html",
+	SMS:     "sms",
+}
+
+// renderMessage evaluates the templates matching the kind of the identifier,
+// SMS messages have no subject. The HTML variant of e-mails is optional.
+func renderMessage(ctx context.Context, config config.Config, kind identifier.Kind, lang string, templates messageTemplates, data template.TemplateData) (message deliver.Message, err error) {
+	_, span := tracing.Start(ctx, "template.render", attribute.String("template.lang", lang))
+	defer func() { tracing.End(span, err) }()
+	if kind == identifier.KindPhone {
+		body, err := evaluateTemplate(config, lang, templates.SMS, data)
+		message.Body = body
+		return message, err
+	}
+	body, err := evaluateTemplate(config, lang, templates.Body, data)
+	if err != nil {
+		return message, err
+	}
+	message.Body = body
+	subject, err := evaluateTemplate(config, lang, templates.Subject, data)
+	if err != nil {
+		return message, err
+	}
+	message.Subject = subject
+	if template.DefaultStore.Has(lang, templates.HTML) {
+		htmlBody, err := evaluateTemplate(config, lang, templates.HTML, data)
+		if err != nil {
+			return message, err
+		}
+		message.HTMLBody = htmlBody
+	}
+	return message, nil
+}
+
+// RequestMetadata describes the request a login token was generated for
+type RequestMetadata struct {
+	IP        string
+	UserAgent string
+	Locale    string
+	Time      time.Time
+	RequestID string
+}
+
+func (m RequestMetadata) auditSource() audit.Source {
+	return audit.Source{
+		IP:        m.IP,
+		UserAgent: m.UserAgent,
+		RequestID: m.RequestID,
+	}
+}
+
+func loginURL(config config.Config, id string, token string) (string, error) {
+	if len(config.LoginURL) == 0 {
+		return "", nil
+	}
+	parsed, err := url.Parse(config.LoginURL)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	query.Set("identifier", id)
+	query.Set("token", token)
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+func NewTemplateData(config config.Config, id string, token string, metadata RequestMetadata) (*template.TemplateData, error) {
+	location, err := config.Templates.Location()
+	if err != nil {
+		return nil, err
+	}
+	link, err := loginURL(config, id, token)
+	if err != nil {
+		return nil, err
+	}
+	requestTime := metadata.Time.In(location)
+	lifetime := time.Second * time.Duration(config.LoginTokenLifeTimeSeconds)
+	return &template.TemplateData{
+		Service:          config.ServiceName,
+		Token:            token,
+		IP:               metadata.IP,
+		Lang:             metadata.Locale,
+		RequestTime:      requestTime,
+		ExpiresAt:        requestTime.Add(lifetime),
+		ExpiresInMinutes: (config.LoginTokenLifeTimeSeconds + 59) / 60,
+		UserAgent:        template.ParseUserAgent(metadata.UserAgent),
+		SupportURL:       config.SupportURL,
+		LoginURL:         link,
+	}, nil
+}
+
+// GenerateAndStoreAndDeliverTokenForIdentifier creates a login token for the
+// canonical identifier and sends it to the address as entered, see
+// identifier.DeliveryAddress. The steps are traced as children of the span
+// in ctx.
+func GenerateAndStoreAndDeliverTokenForIdentifier(ctx context.Context, config config.Config, s state.State, id string, metadata RequestMetadata) error {
+	ctx, span := tracing.Start(ctx, "operations.GenerateAndStoreAndDeliverTokenForIdentifier")
+	err := generateAndStoreAndDeliverToken(ctx, config, *s.WithContext(ctx), id, metadata)
+	tracing.End(span, err)
+	return err
+}
+
+func generateAndStoreAndDeliverToken(ctx context.Context, config config.Config, s state.State, id string, metadata RequestMetadata) error {
+	to, err := identifier.DeliveryAddress(id)
 	if err != nil {
 		return err
 	}
-	err = state.InsertToken(config, identifier, token)
+	id, err = identifier.Canonicalize(config.Identifiers, id)
 	if err != nil {
 		return err
 	}
-	templateData := &template.TemplateData{
-		Service: config.ServiceName,
-		Token:   token,
-		IP:      requestingIP,
+	kind, err := identifier.KindOf(id)
+	if err != nil {
+		return err
 	}
-	body, err := template.EvaluateTemplate("en", "email", *templateData)
+	source := metadata.auditSource()
+	audit.Emit(audit.NewEvent(audit.TokenRequested, id, source))
+	err = policy.CheckLogin(config, s, id)
 	if err != nil {
+		if policy.IsRejection(err) {
+			audit.Emit(audit.NewEvent(audit.TokenRejected, id, source).WithDetail(err))
+		}
 		return err
 	}
-	subject, err := template.EvaluateTemplate("en", "email-subject", *templateData)
+	token, err := token.Generate(config)
+	if err != nil {
+		return err
+	}
+	err = s.InsertToken(config, id, token)
+	if err != nil {
+		if _, ok := err.(*state.TooManyTokensIssued); ok {
+			audit.Emit(audit.NewEvent(audit.Lockout, id, source).WithDetail(err))
+		}
+		return err
+	}
+	if metadata.Time.IsZero() {
+		metadata.Time = time.Now()
+	}
+	templateData, err := NewTemplateData(config, id, token, metadata)
 	if err != nil {
 		return err
 	}
-	agent, err := deliver.AgentForIdentifier(identifier)
+	message, err := renderMessage(ctx, config, kind, metadata.Locale, loginTemplates, *templateData)
 	if err != nil {
 		return err
 	}
-	err = agent.Deliver(config, identifier, subject, body)
+	err = deliver.DefaultRegistry.Deliver(ctx, config, to, message)
 	if err != nil {
+		audit.Emit(audit.NewEvent(audit.DeliveryFailed, id, source).WithDetail(err))
 		return err
 	}
+	audit.Emit(audit.NewEvent(audit.TokenDelivered, id, source))
 	return nil
 }
 
@@ -0,0 +1,119 @@
+package operations
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/identifier"
+	"github.com/mguentner/passwordless/state"
+)
+
+func userField(user state.User, field string) (interface{}, bool) {
+	switch field {
+	case "id":
+		return user.ID, true
+	case "identifier":
+		return user.Identifier, true
+	case "displayName":
+		return user.DisplayName, len(user.DisplayName) > 0
+	case "roles":
+		return user.Roles, len(user.Roles) > 0
+	case "createdAt":
+		return user.CreatedAt, true
+	case "lastLoginAt":
+		return user.LastLoginAt, user.LastLoginAt > 0
+	}
+	if strings.HasPrefix(field, "attributes.") {
+		value, ok := user.Attributes[strings.TrimPrefix(field, "attributes.")]
+		return value, ok
+	}
+	return nil, false
+}
+
+func appendUnique(values []string, seen map[string]bool, add ...string) []string {
+	for _, value := range add {
+		if !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// ValidateRoleAssignments returns an error if a key of `roleAssignments`
+// is not a valid identifier or two keys are the same identifier once
+// canonicalized, e.g. `Alice@example.com` and `alice@Example.com` with
+// `identifiers.lowercaseLocalPart`
+func ValidateRoleAssignments(config config.Config) error {
+	seen := map[string]string{}
+	for key := range config.RoleAssignments {
+		id, err := identifier.Canonicalize(config.Identifiers, key)
+		if err != nil {
+			return fmt.Errorf("Invalid roleAssignments entry %q: %v", key, err)
+		}
+		if other, ok := seen[id]; ok {
+			return fmt.Errorf("roleAssignments entries %q and %q are both %s", other, key, id)
+		}
+		seen[id] = key
+	}
+	return nil
+}
+
+// assignedRoles returns the `roleAssignments` of the canonical identifier,
+// the keys are canonicalized the same way
+func assignedRoles(config config.Config, id string) []string {
+	for key, roles := range config.RoleAssignments {
+		canonical, err := identifier.Canonicalize(config.Identifiers, key)
+		if err == nil && canonical == id {
+			return roles
+		}
+	}
+	return nil
+}
+
+// RolesForUser combines `defaultRoles`, `roleAssignments` and the roles
+// stored for the user
+func RolesForUser(config config.Config, user state.User) []string {
+	seen := map[string]bool{}
+	roles := []string{}
+	roles = appendUnique(roles, seen, config.DefaultRoles...)
+	roles = appendUnique(roles, seen, assignedRoles(config, user.Identifier)...)
+	roles = appendUnique(roles, seen, user.Roles...)
+	return roles
+}
+
+// ScopesForRoles returns the scopes granted by the roles, roles missing
+// in `roles` grant nothing
+func ScopesForRoles(config config.Config, roles []string) []string {
+	seen := map[string]bool{}
+	scopes := []string{}
+	for _, role := range roles {
+		scopes = appendUnique(scopes, seen, config.Roles[role]...)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// UserInfoForUser maps the user to the claims configured in
+// `accessTokenClaims`, empty fields are omitted
+func UserInfoForUser(config config.Config, user state.User) crypto.UserInfo {
+	claims := map[string]interface{}{}
+	for claim, field := range config.AccessTokenClaims {
+		if value, ok := userField(user, field); ok {
+			claims[claim] = value
+		}
+	}
+	roles := RolesForUser(config, user)
+	userInfo := crypto.UserInfo{
+		Identifier: user.Identifier,
+		Roles:      roles,
+		Scope:      strings.Join(ScopesForRoles(config, roles), " "),
+	}
+	if len(claims) > 0 {
+		userInfo.Claims = claims
+	}
+	return userInfo
+}
@@ -0,0 +1,48 @@
+package operations
+
+import (
+	"testing"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/state"
+)
+
+func TestRolesForUserCanonicalAssignments(t *testing.T) {
+	c := config.Config{
+		Identifiers: config.IdentifierConfig{ProviderRules: true},
+		Roles: map[string][]string{
+			"admin": {"admin:*"},
+			"ops":   {"ops:deploy"},
+		},
+		RoleAssignments: map[string][]string{
+			"J.Doe@GoogleMail.com": {"admin"},
+			"alice@Example.com":    {"ops"},
+		},
+	}
+	err := ValidateRoleAssignments(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSet := []struct {
+		identifier string
+		expected   string
+	}{
+		{identifier: "jdoe@gmail.com", expected: "admin"},
+		{identifier: "alice@example.com", expected: "ops"},
+	}
+	for _, test := range testSet {
+		roles := RolesForUser(c, state.User{Identifier: test.identifier})
+		if len(roles) != 1 || roles[0] != test.expected {
+			t.Errorf("Expected %s for %s, got %v", test.expected, test.identifier, roles)
+		}
+	}
+
+	c.RoleAssignments["jdoe+work@gmail.com"] = []string{"ops"}
+	if err := ValidateRoleAssignments(c); err == nil {
+		t.Error("Expected colliding assignments to be rejected")
+	}
+	c.RoleAssignments = map[string][]string{"not an address": {"ops"}}
+	if err := ValidateRoleAssignments(c); err == nil {
+		t.Error("Expected an invalid identifier to be rejected")
+	}
+}
@@ -0,0 +1,170 @@
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/identifier"
+)
+
+type DomainNotAllowed struct{}
+
+func (e *DomainNotAllowed) Error() string {
+	return "DomainNotAllowed"
+}
+
+type DomainBlocked struct{}
+
+func (e *DomainBlocked) Error() string {
+	return "DomainBlocked"
+}
+
+type DisposableDomain struct{}
+
+func (e *DisposableDomain) Error() string {
+	return "DisposableDomain"
+}
+
+// IsRejection reports whether err was returned because of the policy
+func IsRejection(err error) bool {
+	switch err.(type) {
+	case *DomainNotAllowed, *DomainBlocked, *DisposableDomain, *NotInvited, *RegistrationClosed:
+		return true
+	}
+	return false
+}
+
+var (
+	disposableMutex   sync.Mutex
+	disposableDomains = map[string]map[string]bool{}
+)
+
+func readDomainList(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[line] = true
+	}
+	return domains, scanner.Err()
+}
+
+// LoadDisposableDomains reads the list at path, it is cached for all
+// subsequent calls of Check
+func LoadDisposableDomains(path string) (map[string]bool, error) {
+	disposableMutex.Lock()
+	defer disposableMutex.Unlock()
+	if domains, ok := disposableDomains[path]; ok {
+		return domains, nil
+	}
+	domains, err := readDomainList(path)
+	if err != nil {
+		return nil, err
+	}
+	disposableDomains[path] = domains
+	return domains, nil
+}
+
+func matchesAny(patterns []string, domain string) bool {
+	for _, pattern := range patterns {
+		if identifier.DomainMatches(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDisposable(domains map[string]bool, domain string) bool {
+	for len(domain) > 0 {
+		if domains[domain] {
+			return true
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+	return false
+}
+
+// ValidateAllowedAddresses returns an error if an entry of
+// `policy.allowedAddresses` is not a valid e-mail address, invalid entries
+// never match
+func ValidateAllowedAddresses(c config.Config) error {
+	for _, address := range c.Policy.AllowedAddresses {
+		_, err := identifier.CanonicalizeEmail(c.Identifiers, address)
+		if err != nil {
+			return fmt.Errorf("Invalid policy.allowedAddresses entry %q: %v", address, err)
+		}
+	}
+	return nil
+}
+
+// isAllowedAddress canonicalizes the allowed addresses the same way the
+// identifiers of requests are canonicalized before comparing them
+func isAllowedAddress(c config.Config, id string) bool {
+	for _, address := range c.Policy.AllowedAddresses {
+		canonical, err := identifier.CanonicalizeEmail(c.Identifiers, address)
+		if err == nil && canonical == id {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowlisted reports whether allowedAddresses or allowedDomains match
+// the identifier
+func isAllowlisted(c config.Config, id string) bool {
+	return isAllowedAddress(c, id) || matchesAny(c.Policy.AllowedDomains, identifier.Domain(id))
+}
+
+// checkDenylists applies blockedDomains and the disposable domains,
+// allowedAddresses are exempt
+func checkDenylists(c config.Config, id string) error {
+	policyConfig := c.Policy
+	domain := identifier.Domain(id)
+	if len(domain) == 0 || isAllowedAddress(c, id) {
+		return nil
+	}
+	if matchesAny(policyConfig.BlockedDomains, domain) {
+		return &DomainBlocked{}
+	}
+	if len(policyConfig.DisposableDomainsPath) > 0 {
+		domains, err := LoadDisposableDomains(policyConfig.DisposableDomainsPath)
+		if err != nil {
+			return err
+		}
+		if isDisposable(domains, domain) {
+			return &DisposableDomain{}
+		}
+	}
+	return nil
+}
+
+// Check returns an error if the policy rejects the canonical identifier.
+// Only e-mail addresses are subject to the policy.
+func Check(c config.Config, id string) error {
+	policyConfig := c.Policy
+	err := checkDenylists(c, id)
+	if err != nil {
+		return err
+	}
+	allowlist := len(policyConfig.AllowedDomains) > 0 || len(policyConfig.AllowedAddresses) > 0
+	if allowlist && len(identifier.Domain(id)) > 0 && !isAllowlisted(c, id) {
+		return &DomainNotAllowed{}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/identifier"
+)
+
+func TestCheck(t *testing.T) {
+	disposablePath := filepath.Join(t.TempDir(), "disposable.txt")
+	err := ioutil.WriteFile(disposablePath, []byte("# comment\nmailinator.com\n\nTrashmail.net\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policyConfig := config.PolicyConfig{
+		AllowedDomains:        []string{"example.com", "*.example.org"},
+		BlockedDomains:        []string{"blocked.example.org"},
+		AllowedAddresses:      []string{"contractor@gmail.com", "vip@blocked.example.org"},
+		DisposableDomainsPath: disposablePath,
+	}
+	testSet := []struct {
+		identifier string
+		expected   error
+	}{
+		{identifier: "alice@example.com", expected: nil},
+		{identifier: "alice@EXAMPLE.com", expected: nil},
+		{identifier: "alice@sub.example.org", expected: nil},
+		{identifier: "alice@example.org", expected: &DomainNotAllowed{}},
+		{identifier: "alice@gmail.com", expected: &DomainNotAllowed{}},
+		{identifier: "contractor@gmail.com", expected: nil},
+		{identifier: "alice@blocked.example.org", expected: &DomainBlocked{}},
+		{identifier: "vip@blocked.example.org", expected: nil},
+		{identifier: "alice@mailinator.com", expected: &DisposableDomain{}},
+		{identifier: "alice@x.trashmail.net", expected: &DisposableDomain{}},
+		{identifier: "+491701234567", expected: nil},
+	}
+	for _, test := range testSet {
+		err := Check(config.Config{Policy: policyConfig}, test.identifier)
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("Expected %s to be accepted, got %v", test.identifier, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.expected.Error() {
+			t.Errorf("Expected %v for %s, got %v", test.expected, test.identifier, err)
+		}
+		if !IsRejection(err) {
+			t.Errorf("Expected %v to be a rejection", err)
+		}
+	}
+}
+
+func TestCheckOpen(t *testing.T) {
+	err := Check(config.Config{}, "anyone@anywhere.com")
+	if err != nil {
+		t.Fatalf("Expected an empty policy to accept everything: %v", err)
+	}
+}
+
+func TestCheckCanonicalAllowedAddresses(t *testing.T) {
+	c := config.Config{
+		Identifiers: config.IdentifierConfig{ProviderRules: true, PlusAddressingDomains: []string{"example.com"}},
+		Policy: config.PolicyConfig{
+			AllowedDomains:   []string{"example.org"},
+			AllowedAddresses: []string{"first.last+x@gmail.com", "bob+team@Example.com", "vip@bücher.example"},
+		},
+	}
+	err := ValidateAllowedAddresses(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{"firstlast@googlemail.com", "first.last+y@gmail.com", "bob+other@example.com", "vip@BÜCHER.example"} {
+		id, err := identifier.Canonicalize(c.Identifiers, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Check(c, id)
+		if err != nil {
+			t.Errorf("Expected %s (%s) to be allowed, got %v", address, id, err)
+		}
+	}
+	id, err := identifier.Canonicalize(c.Identifiers, "other@gmail.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(c, id); err == nil {
+		t.Error("Expected other@gmail.com to be rejected")
+	}
+	c.Policy.AllowedAddresses = []string{"not an address"}
+	if err := ValidateAllowedAddresses(c); err == nil {
+		t.Error("Expected an invalid address to fail")
+	}
+}
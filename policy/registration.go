@@ -0,0 +1,64 @@
+package policy
+
+import (
+	"github.com/mguentner/passwordless/config"
+	"github.com/mguentner/passwordless/state"
+)
+
+type NotInvited struct{}
+
+func (e *NotInvited) Error() string {
+	return "NotInvited"
+}
+
+type RegistrationClosed struct{}
+
+func (e *RegistrationClosed) Error() string {
+	return "RegistrationClosed"
+}
+
+// CheckRegistration returns an error if the identifier is unknown and the
+// registration mode does not allow it to log in for the first time
+func CheckRegistration(config config.Config, s state.State, id string) error {
+	mode := config.Registration.GetMode()
+	if mode == "open" {
+		return nil
+	}
+	_, err := s.UserByIdentifier(id)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*state.NoSuchUser); !ok {
+		return err
+	}
+	switch mode {
+	case "allowlist":
+		if isAllowlisted(config, id) {
+			return nil
+		}
+		return &RegistrationClosed{}
+	case "invite":
+		_, err := s.InvitationForIdentifier(id)
+		if _, ok := err.(*state.NoSuchInvitation); ok {
+			return &NotInvited{}
+		}
+		return err
+	}
+	return &RegistrationClosed{}
+}
+
+// CheckLogin applies the policy and the registration mode to a login
+// request. In `allowlist` mode the allowlist of the policy only restricts
+// identifiers that are not registered yet.
+func CheckLogin(config config.Config, s state.State, id string) error {
+	var err error
+	if config.Registration.GetMode() == "allowlist" {
+		err = checkDenylists(config, id)
+	} else {
+		err = Check(config, id)
+	}
+	if err != nil {
+		return err
+	}
+	return CheckRegistration(config, s, id)
+}
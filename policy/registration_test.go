@@ -0,0 +1,104 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/state"
+	"github.com/mguentner/passwordless/test"
+)
+
+func TestCheckRegistration(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := state.State{
+		DB: db,
+	}
+	_, err = s.EnsureUser("known@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.InsertInvitation("invited@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := test.DefaultConfig()
+	c.Policy.AllowedDomains = []string{"*.example.org"}
+	c.Policy.AllowedAddresses = []string{"friend@example.net"}
+	testSet := []struct {
+		mode       string
+		identifier string
+		expected   error
+	}{
+		{mode: "", identifier: "anyone@example.com", expected: nil},
+		{mode: "allowlist", identifier: "known@example.com", expected: nil},
+		{mode: "allowlist", identifier: "alice@team.example.org", expected: nil},
+		{mode: "allowlist", identifier: "friend@example.net", expected: nil},
+		{mode: "allowlist", identifier: "anyone@example.com", expected: &RegistrationClosed{}},
+		{mode: "invite", identifier: "known@example.com", expected: nil},
+		{mode: "invite", identifier: "invited@example.com", expected: nil},
+		{mode: "invite", identifier: "alice@team.example.org", expected: &NotInvited{}},
+	}
+	for _, test := range testSet {
+		c.Registration.Mode = test.mode
+		err := CheckRegistration(c, s, test.identifier)
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("Expected %s to pass in mode %q, got %v", test.identifier, test.mode, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.expected.Error() {
+			t.Errorf("Expected %v for %s in mode %q, got %v", test.expected, test.identifier, test.mode, err)
+		}
+	}
+}
+
+func TestCheckLoginAllowlist(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := state.State{
+		DB: db,
+	}
+	_, err = s.EnsureUser("known@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := test.DefaultConfig()
+	c.Policy.AllowedDomains = []string{"example.org"}
+	c.Policy.BlockedDomains = []string{"blocked.example.org"}
+	// Everyone outside the allowlist is rejected, registered or not
+	for _, id := range []string{"known@example.com", "new@example.com"} {
+		err := CheckLogin(c, s, id)
+		if _, ok := err.(*DomainNotAllowed); !ok {
+			t.Errorf("Expected DomainNotAllowed for %s in open mode, got %v", id, err)
+		}
+	}
+	c.Registration.Mode = "allowlist"
+	testSet := []struct {
+		identifier string
+		expected   error
+	}{
+		{identifier: "known@example.com", expected: nil},
+		{identifier: "new@example.org", expected: nil},
+		{identifier: "new@example.com", expected: &RegistrationClosed{}},
+		{identifier: "new@blocked.example.org", expected: &DomainBlocked{}},
+	}
+	for _, test := range testSet {
+		err := CheckLogin(c, s, test.identifier)
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("Expected %s to pass, got %v", test.identifier, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.expected.Error() {
+			t.Errorf("Expected %v for %s, got %v", test.expected, test.identifier, err)
+		}
+	}
+}
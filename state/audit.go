@@ -0,0 +1,63 @@
+package state
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// Audit events are stored as `audit-<unix nanoseconds>-<nonce>`, the
+// timestamp is zero padded so keys sort chronologically
+const auditKeyPrefix = "audit-"
+
+func auditKey(t time.Time) []byte {
+	return []byte(fmt.Sprintf("%s%020d-%d", auditKeyPrefix, t.UnixNano(), rand.Int()))
+}
+
+// InsertAuditEvent stores an encoded audit event that expires after
+// retention
+func (s *State) InsertAuditEvent(t time.Time, data []byte, retention time.Duration) error {
+	return s.update("InsertAuditEvent", func(txn *badger.Txn) error {
+		e := badger.NewEntry(auditKey(t), data).WithTTL(retention)
+		return txn.SetEntry(e)
+	})
+}
+
+// EachAuditEvent calls fn with every encoded audit event stored since the
+// given time, newest first, until fn returns false. A zero since includes
+// all events. data is only valid during the call.
+func (s *State) EachAuditEvent(since time.Time, fn func(data []byte) (bool, error)) error {
+	return s.view("EachAuditEvent", func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte(auditKeyPrefix)
+		// UnixNano is undefined for the zero time
+		sinceKey := prefix
+		if !since.IsZero() {
+			sinceKey = []byte(fmt.Sprintf("%s%020d", auditKeyPrefix, since.UnixNano()))
+		}
+		for it.Seek(append(prefix, 0xff)); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if string(item.Key()) < string(sinceKey) {
+				break
+			}
+			next := true
+			err := item.Value(func(data []byte) error {
+				var err error
+				next, err = fn(data)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if !next {
+				break
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,54 @@
+package state
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+type DatabaseClosed struct{}
+
+func (e *DatabaseClosed) Error() string {
+	return "DatabaseClosed"
+}
+
+type ProbeMismatch struct{}
+
+func (e *ProbeMismatch) Error() string {
+	return "ProbeMismatch"
+}
+
+const healthKeyPrefix = "health-"
+
+// All probes overwrite the same key which expires on its own, frequent
+// polling does not leave records behind
+var probeKey = []byte(healthKeyPrefix + "probe")
+
+// Probe writes and reads back a value to check that the database is usable
+func (s *State) Probe() error {
+	if s.DB.IsClosed() {
+		return &DatabaseClosed{}
+	}
+	value := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	err := s.update("Probe", func(txn *badger.Txn) error {
+		e := badger.NewEntry(probeKey, value).WithTTL(time.Minute)
+		return txn.SetEntry(e)
+	})
+	if err != nil {
+		return err
+	}
+	return s.view("Probe", func(txn *badger.Txn) error {
+		item, err := txn.Get(probeKey)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(stored []byte) error {
+			if !bytes.Equal(stored, value) {
+				return &ProbeMismatch{}
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,100 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+type Invitation struct {
+	Identifier string `json:"identifier"`
+	CreatedAt  int64  `json:"createdAt"`
+	ExpiresAt  int64  `json:"expiresAt"`
+}
+
+type NoSuchInvitation struct{}
+
+func (e *NoSuchInvitation) Error() string {
+	return "NoSuchInvitation"
+}
+
+const invitationKeyPrefix = "invitation-"
+
+func invitationKey(identifier string) []byte {
+	return []byte(invitationKeyPrefix + EncodeIdentifier(identifier))
+}
+
+// InsertInvitation stores an invitation that expires after lifetime, an
+// existing invitation for the identifier is replaced
+func (s *State) InsertInvitation(identifier string, lifetime time.Duration) (*Invitation, error) {
+	now := time.Now()
+	invitation := &Invitation{
+		Identifier: identifier,
+		CreatedAt:  now.Unix(),
+		ExpiresAt:  now.Add(lifetime).Unix(),
+	}
+	data, err := json.Marshal(invitation)
+	if err != nil {
+		return nil, err
+	}
+	err = s.update("InsertInvitation", func(txn *badger.Txn) error {
+		e := badger.NewEntry(invitationKey(identifier), data).WithTTL(lifetime)
+		return txn.SetEntry(e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func (s *State) InvitationForIdentifier(identifier string) (*Invitation, error) {
+	invitation := &Invitation{}
+	err := s.view("InvitationForIdentifier", func(txn *badger.Txn) error {
+		item, err := txn.Get(invitationKey(identifier))
+		if err == badger.ErrKeyNotFound {
+			return &NoSuchInvitation{}
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, invitation)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func (s *State) DeleteInvitation(identifier string) error {
+	return s.update("DeleteInvitation", func(txn *badger.Txn) error {
+		return txn.Delete(invitationKey(identifier))
+	})
+}
+
+func (s *State) AllInvitations() ([]Invitation, error) {
+	invitations := []Invitation{}
+	err := s.view("AllInvitations", func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(invitationKeyPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				invitation := Invitation{}
+				err := json.Unmarshal(v, &invitation)
+				if err != nil {
+					return err
+				}
+				invitations = append(invitations, invitation)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return invitations, err
+}
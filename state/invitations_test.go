@@ -0,0 +1,48 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+func TestInvitations(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := State{
+		DB: db,
+	}
+	_, err = state.InvitationForIdentifier("foo@bar.com")
+	if _, ok := err.(*NoSuchInvitation); !ok {
+		t.Fatalf("Expected NoSuchInvitation, got %v", err)
+	}
+	_, err = state.InsertInvitation("foo@bar.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitation, err := state.InvitationForIdentifier("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invitation.Identifier != "foo@bar.com" || invitation.ExpiresAt <= invitation.CreatedAt {
+		t.Fatalf("Unexpected invitation %+v", invitation)
+	}
+	invitations, err := state.AllInvitations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invitations) != 1 {
+		t.Fatalf("Expected exactly one invitation, got %d", len(invitations))
+	}
+	err = state.DeleteInvitation("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = state.InvitationForIdentifier("foo@bar.com")
+	if _, ok := err.(*NoSuchInvitation); !ok {
+		t.Fatalf("Expected NoSuchInvitation after deleting, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package state
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// Record types as returned by RecordType
+const (
+	RecordToken      = "token"
+	RecordLocale     = "locale"
+	RecordUserIndex  = "userIndex"
+	RecordUser       = "user"
+	RecordInvitation = "invitation"
+	RecordAudit      = "audit"
+	RecordHealth     = "health"
+	RecordPurged     = "purged"
+	RecordUnknown    = "unknown"
+)
+
+// RecordType derives the type of a record from its key
+func RecordType(key []byte) string {
+	k := string(key)
+	switch {
+	case strings.HasPrefix(k, userKeyPrefix):
+		return RecordUser
+	case strings.HasPrefix(k, invitationKeyPrefix):
+		return RecordInvitation
+	case strings.HasPrefix(k, auditKeyPrefix):
+		return RecordAudit
+	case strings.HasPrefix(k, healthKeyPrefix):
+		return RecordHealth
+	}
+	// Encoded identifiers never contain `-`
+	parts := strings.SplitN(k, "-", 3)
+	if len(parts) < 2 {
+		return RecordUnknown
+	}
+	switch parts[1] {
+	case "token":
+		return RecordToken
+	case "locale":
+		return RecordLocale
+	case "user":
+		return RecordUserIndex
+	case "purged":
+		return RecordPurged
+	}
+	return RecordUnknown
+}
+
+type KeyInfo struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// Unix timestamp, 0 if the record does not expire
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	Size      int64 `json:"size"`
+}
+
+// KeysByType lists all keys grouped by RecordType, values are not read as
+// they might contain login tokens
+func (s *State) KeysByType() (map[string][]KeyInfo, error) {
+	groups := map[string][]KeyInfo{}
+	err := s.view("KeysByType", func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			recordType := RecordType(item.Key())
+			groups[recordType] = append(groups[recordType], KeyInfo{
+				Key:       string(item.Key()),
+				Type:      recordType,
+				ExpiresAt: int64(item.ExpiresAt()),
+				Size:      item.EstimatedSize(),
+			})
+		}
+		return nil
+	})
+	return groups, err
+}
+
+type TokenCount struct {
+	EncodedIdentifier string `json:"encodedIdentifier"`
+	// Only known if a user exists for the identifier
+	Identifier string `json:"identifier,omitempty"`
+	Count      int    `json:"count"`
+}
+
+// TokenCounts counts the live login tokens per identifier
+func (s *State) TokenCounts() ([]TokenCount, error) {
+	counts := []TokenCount{}
+	err := s.view("TokenCounts", func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		index := map[string]int{}
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if RecordType(key) != RecordToken {
+				continue
+			}
+			encoded := strings.SplitN(string(key), "-", 2)[0]
+			i, ok := index[encoded]
+			if !ok {
+				i = len(counts)
+				index[encoded] = i
+				counts = append(counts, TokenCount{EncodedIdentifier: encoded})
+			}
+			counts[i].Count++
+		}
+		for i, count := range counts {
+			user, err := getUserByEncodedIdentifier(txn, count.EncodedIdentifier)
+			if err == nil {
+				counts[i].Identifier = user.Identifier
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
+
+func purgedKey(identifier string) []byte {
+	return []byte(fmt.Sprintf("%s-purged", EncodeIdentifier(identifier)))
+}
+
+// PurgeIdentifier removes every record of the identifier: login tokens,
+// locale, invitation and user. Returns the number of removed keys.
+// Outstanding refresh tokens stay unusable without a revocation record,
+// refreshing requires the user and its id to match the token. Refresh
+// tokens issued before users were introduced carry no id, a marker
+// records the purge for them, see WasPurged.
+func (s *State) PurgeIdentifier(identifier string) (int, error) {
+	count := 0
+	err := s.update("PurgeIdentifier", func(txn *badger.Txn) error {
+		keys := [][]byte{invitationKey(identifier)}
+		user, err := getUserByIdentifier(txn, identifier)
+		if err == nil {
+			keys = append(keys, userKey(user.ID))
+		} else if _, ok := err.(*NoSuchUser); !ok {
+			return err
+		}
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		prefix := []byte(EncodeIdentifier(identifier) + "-")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			// Kept when purging again
+			if RecordType(it.Item().Key()) == RecordPurged {
+				continue
+			}
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+		for _, key := range keys {
+			_, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = txn.Delete(key)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		return txn.Set(purgedKey(identifier), []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	})
+	return count, err
+}
+
+// WasPurged reports whether PurgeIdentifier was called for the identifier
+func (s *State) WasPurged(identifier string) (bool, error) {
+	purged := false
+	err := s.view("WasPurged", func(txn *badger.Txn) error {
+		_, err := txn.Get(purgedKey(identifier))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		purged = err == nil
+		return err
+	})
+	return purged, err
+}
+
+// Compact flattens the LSM tree and runs the value log garbage collection
+// until there is nothing left to rewrite. Returns the number of rewritten
+// value log files.
+func (s *State) Compact(discardRatio float64) (int, error) {
+	err := s.DB.Flatten(1)
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for {
+		err = s.DB.RunValueLogGC(discardRatio)
+		if err == badger.ErrNoRewrite || err == badger.ErrGCInMemoryMode {
+			return rewritten, nil
+		}
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+}
+
+type Stats struct {
+	LSMSize  int64          `json:"lsmSize"`
+	VLogSize int64          `json:"vlogSize"`
+	Keys     map[string]int `json:"keys"`
+}
+
+// Stats returns the on-disk size of the database and the number of keys
+// per record type
+func (s *State) Stats() (*Stats, error) {
+	lsm, vlog := s.DB.Size()
+	stats := &Stats{
+		LSMSize:  lsm,
+		VLogSize: vlog,
+		Keys:     map[string]int{},
+	}
+	groups, err := s.KeysByType()
+	if err != nil {
+		return nil, err
+	}
+	for recordType, keys := range groups {
+		stats.Keys[recordType] = len(keys)
+	}
+	return stats, nil
+}
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/mguentner/passwordless/test"
+)
+
+func TestPurgeIdentifier(t *testing.T) {
+	config := test.DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := State{
+		DB: db,
+	}
+	for _, id := range []string{"foo@bar.com", "other@bar.com"} {
+		err = state.InsertToken(config, id, "1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = state.SetLocale(id, "de")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = state.RecordLogin(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = state.InsertInvitation("foo@bar.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := state.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{
+		RecordToken:      2,
+		RecordLocale:     2,
+		RecordUser:       2,
+		RecordUserIndex:  2,
+		RecordInvitation: 1,
+	}
+	for recordType, count := range expected {
+		if stats.Keys[recordType] != count {
+			t.Errorf("Expected %d %s keys, got %d", count, recordType, stats.Keys[recordType])
+		}
+	}
+	counts, err := state.TokenCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 || counts[0].Count != 1 || len(counts[0].Identifier) == 0 {
+		t.Errorf("Unexpected token counts %+v", counts)
+	}
+	deleted, err := state.PurgeIdentifier("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 5 {
+		t.Errorf("Expected 5 deleted keys, got %d", deleted)
+	}
+	_, err = state.UserByIdentifier("foo@bar.com")
+	if _, ok := err.(*NoSuchUser); !ok {
+		t.Errorf("Expected NoSuchUser, got %v", err)
+	}
+	keys, err := state.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The keys of the other identifier and the purge marker
+	if len(keys) != 5 {
+		t.Errorf("Expected the keys of the other identifier to be kept, got %d keys", len(keys))
+	}
+	for _, id := range []string{"foo@bar.com", "other@bar.com"} {
+		purged, err := state.WasPurged(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purged != (id == "foo@bar.com") {
+			t.Errorf("Unexpected purge marker for %s: %v", id, purged)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package state
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mguentner/passwordless/config"
 	myCrypto "github.com/mguentner/passwordless/crypto"
+	"github.com/mguentner/passwordless/tracing"
 	"github.com/rs/zerolog/log"
 
 	badger "github.com/dgraph-io/badger/v3"
@@ -17,6 +21,29 @@ import (
 type State struct {
 	DB          *badger.DB
 	RSAKeyPairs []myCrypto.PublicPrivateRSAKeyPair
+	ctx         context.Context
+}
+
+// WithContext returns a shallow copy of the state whose operations are
+// traced as children of the span in ctx
+func (s *State) WithContext(ctx context.Context) *State {
+	copy := *s
+	copy.ctx = ctx
+	return &copy
+}
+
+func (s *State) view(name string, fn func(txn *badger.Txn) error) error {
+	_, span := tracing.Start(s.ctx, "state."+name)
+	err := s.DB.View(fn)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *State) update(name string, fn func(txn *badger.Txn) error) error {
+	_, span := tracing.Start(s.ctx, "state."+name)
+	err := s.DB.Update(fn)
+	tracing.End(span, err)
+	return err
 }
 
 type ZerologBadgerLogger struct {
@@ -60,7 +87,7 @@ func (s *State) TokensForIdentifier(identifier string) ([]string, error) {
 	encodedIdentifier := EncodeIdentifier(identifier)
 	prefix := fmt.Sprintf("%s-token", encodedIdentifier)
 	tokens := []string{}
-	err := s.DB.View(func(txn *badger.Txn) error {
+	err := s.view("TokensForIdentifier", func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
@@ -78,6 +105,69 @@ func (s *State) TokensForIdentifier(identifier string) ([]string, error) {
 	return tokens, err
 }
 
+// TokenInfo describes an outstanding login token without revealing it
+type TokenInfo struct {
+	CreatedAt int64 `json:"createdAt"`
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// TokenInfoForIdentifier lists the outstanding login tokens of the
+// identifier, oldest first
+func (s *State) TokenInfoForIdentifier(identifier string) ([]TokenInfo, error) {
+	prefix := []byte(fmt.Sprintf("%s-token", EncodeIdentifier(identifier)))
+	infos := []TokenInfo{}
+	err := s.view("TokenInfoForIdentifier", func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			info := TokenInfo{
+				ExpiresAt: int64(item.ExpiresAt()),
+			}
+			// <encoded identifier>-token-<timestamp>-<nonce>
+			parts := strings.Split(string(item.Key()[len(prefix):]), "-")
+			if len(parts) == 3 {
+				createdAt, err := strconv.ParseInt(parts[1], 10, 64)
+				if err == nil {
+					info.CreatedAt = createdAt
+				}
+			}
+			infos = append(infos, info)
+		}
+		return nil
+	})
+	return infos, err
+}
+
+// DeleteTokensForIdentifier removes all outstanding login tokens of the
+// identifier which lifts a TooManyTokensIssued lock. Returns the number
+// of removed tokens.
+func (s *State) DeleteTokensForIdentifier(identifier string) (int, error) {
+	prefix := []byte(fmt.Sprintf("%s-token", EncodeIdentifier(identifier)))
+	count := 0
+	err := s.update("DeleteTokensForIdentifier", func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		keys := [][]byte{}
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+		for _, key := range keys {
+			err := txn.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		count = len(keys)
+		return nil
+	})
+	return count, err
+}
+
 type TooManyTokensIssued struct{}
 
 func (e *TooManyTokensIssued) Error() string {
@@ -89,11 +179,11 @@ func (s *State) InsertToken(config config.Config, identifier string, token strin
 	encodedIdentifier := EncodeIdentifier(identifier)
 	nonce := rand.Int()
 	key := fmt.Sprintf("%s-token-%d-%d", encodedIdentifier, currentTimeStamp, nonce)
-	err := s.DB.Update(func(txn *badger.Txn) error {
+	err := s.update("InsertToken", func(txn *badger.Txn) error {
 		tokens := []string{}
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
-		prefix := []byte(encodedIdentifier)
+		prefix := []byte(fmt.Sprintf("%s-token", encodedIdentifier))
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			err := item.Value(func(v []byte) error {
@@ -117,7 +207,7 @@ func keyForIdentifierTokenPair(txn *badger.Txn, identifier string, token string)
 	encodedIdentifier := EncodeIdentifier(identifier)
 	it := txn.NewIterator(badger.DefaultIteratorOptions)
 	defer it.Close()
-	prefix := []byte(encodedIdentifier)
+	prefix := []byte(fmt.Sprintf("%s-token", encodedIdentifier))
 	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 		item := it.Item()
 		key := []byte{}
@@ -141,7 +231,7 @@ func keyForIdentifierTokenPair(txn *badger.Txn, identifier string, token string)
 
 func (s *State) KeyForIdentifierTokenPair(identifier string, token string) ([]byte, error) {
 	key := []byte{}
-	err := s.DB.View(func(txn *badger.Txn) error {
+	err := s.view("KeyForIdentifierTokenPair", func(txn *badger.Txn) error {
 		k, err := keyForIdentifierTokenPair(txn, identifier, token)
 		if err != nil {
 			return err
@@ -159,7 +249,7 @@ func (e *NoSuchIdentifierTokenPair) Error() string {
 }
 
 func (s *State) InvalidateToken(identifier string, token string) error {
-	err := s.DB.Update(func(txn *badger.Txn) error {
+	err := s.update("InvalidateToken", func(txn *badger.Txn) error {
 		key, err := keyForIdentifierTokenPair(txn, identifier, token)
 		if err != nil {
 			return err
@@ -171,3 +261,31 @@ func (s *State) InvalidateToken(identifier string, token string) error {
 	})
 	return err
 }
+
+// SetLocale records the language messages for the identifier were sent in
+func (s *State) SetLocale(identifier string, locale string) error {
+	key := fmt.Sprintf("%s-locale", EncodeIdentifier(identifier))
+	return s.update("SetLocale", func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), []byte(locale))
+	})
+}
+
+// LocaleForIdentifier returns the recorded locale or an empty string
+func (s *State) LocaleForIdentifier(identifier string) (string, error) {
+	key := fmt.Sprintf("%s-locale", EncodeIdentifier(identifier))
+	locale := ""
+	err := s.view("LocaleForIdentifier", func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			locale = string(v)
+			return nil
+		})
+	})
+	return locale, err
+}
@@ -1,7 +1,10 @@
 package state
 
 import (
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	badger "github.com/dgraph-io/badger/v3"
 	"github.com/mguentner/passwordless/test"
@@ -117,4 +120,172 @@ func TestInvalidateToken(t *testing.T) {
 	}
 }
 
+func TestLocale(t *testing.T) {
+	config := test.DefaultConfig()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := State{
+		DB: db,
+	}
+	locale, err := state.LocaleForIdentifier("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locale != "" {
+		t.Fatalf("Expected no locale, got %s", locale)
+	}
+	err = state.SetLocale("foo@bar.com", "de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locale, err = state.LocaleForIdentifier("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locale != "de" {
+		t.Fatalf("Expected de, got %s", locale)
+	}
+	config.MaxLoginTokenCount = 1
+	err = state.InsertToken(config, "foo@bar.com", "1234")
+	if err != nil {
+		t.Fatalf("Expected the locale not to count as a token: %v", err)
+	}
+	err = state.InvalidateToken("foo@bar.com", "de")
+	if err == nil {
+		t.Fatal("Expected the locale not to be accepted as a token")
+	}
+}
+
 // TODO write timeout test
+
+func TestTokenInfoAndDeleteTokens(t *testing.T) {
+	config := test.DefaultConfig()
+	config.MaxLoginTokenCount = 2
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := State{
+		DB: db,
+	}
+	for _, token := range []string{"1234", "5678"} {
+		err = state.InsertToken(config, "foo@bar.com", token)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = state.SetLocale("foo@bar.com", "de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.InsertToken(config, "foo@bar.com", "9012")
+	if _, ok := err.(*TooManyTokensIssued); !ok {
+		t.Fatalf("Expected TooManyTokensIssued, got %v", err)
+	}
+	infos, err := state.TokenInfoForIdentifier("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 tokens, got %d", len(infos))
+	}
+	for _, info := range infos {
+		if info.CreatedAt == 0 || info.ExpiresAt <= info.CreatedAt {
+			t.Errorf("Unexpected token info %+v", info)
+		}
+	}
+	deleted, err := state.DeleteTokensForIdentifier("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expected 2 deleted tokens, got %d", deleted)
+	}
+	err = state.InsertToken(config, "foo@bar.com", "9012")
+	if err != nil {
+		t.Fatalf("Expected the identifier to be unlocked, got %v", err)
+	}
+	locale, err := state.LocaleForIdentifier("foo@bar.com")
+	if err != nil || locale != "de" {
+		t.Errorf("Expected the locale to be kept, got %s %v", locale, err)
+	}
+}
+
+func TestEachAuditEvent(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := State{
+		DB: db,
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		err = state.InsertAuditEvent(start.Add(time.Duration(i-1)*time.Second), []byte(strconv.Itoa(i)), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	visited := []string{}
+	err = state.EachAuditEvent(start, func(data []byte) (bool, error) {
+		visited = append(visited, string(data))
+		return len(visited) < 2, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(visited, ",") != "4,3" {
+		t.Errorf("Expected the iteration to stop after the two newest events, got %v", visited)
+	}
+	visited = []string{}
+	err = state.EachAuditEvent(start, func(data []byte) (bool, error) {
+		visited = append(visited, string(data))
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 4 {
+		t.Errorf("Expected the event before since to be skipped, got %v", visited)
+	}
+	visited = []string{}
+	err = state.EachAuditEvent(time.Time{}, func(data []byte) (bool, error) {
+		visited = append(visited, string(data))
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 5 {
+		t.Errorf("Expected all events without since, got %v", visited)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := State{
+		DB: db,
+	}
+	for i := 0; i < 3; i++ {
+		err = state.Probe()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups, err := state.KeysByType()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups[RecordHealth]) != 1 {
+		t.Errorf("Expected the probes to share one key, got %v", groups[RecordHealth])
+	}
+	db.Close()
+	if _, ok := state.Probe().(*DatabaseClosed); !ok {
+		t.Error("Expected DatabaseClosed after closing the database")
+	}
+}
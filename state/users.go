@@ -0,0 +1,225 @@
+package state
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// A User is created on the first successful login of an identifier
+type User struct {
+	// Stable and random, used as `sub` in tokens
+	ID          string            `json:"id"`
+	Identifier  string            `json:"identifier"`
+	CreatedAt   int64             `json:"createdAt"`
+	LastLoginAt int64             `json:"lastLoginAt"`
+	DisplayName string            `json:"displayName,omitempty"`
+	Roles       []string          `json:"roles,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	// Time of the last RevokeSessions call
+	SessionsRevokedAt int64 `json:"sessionsRevokedAt,omitempty"`
+	// Incremented by RevokeSessions, refresh tokens carry the generation
+	// they were issued in and are rejected once it is outdated
+	SessionGeneration uint64 `json:"sessionGeneration,omitempty"`
+}
+
+type NoSuchUser struct{}
+
+func (e *NoSuchUser) Error() string {
+	return "NoSuchUser"
+}
+
+// Users are stored under `user-<id>`, `<encoded identifier>-user` points
+// to the id
+const userKeyPrefix = "user-"
+
+func userKey(id string) []byte {
+	return []byte(userKeyPrefix + id)
+}
+
+func userIndexKey(identifier string) []byte {
+	return encodedUserIndexKey(EncodeIdentifier(identifier))
+}
+
+func encodedUserIndexKey(encodedIdentifier string) []byte {
+	return []byte(fmt.Sprintf("%s-user", encodedIdentifier))
+}
+
+func newUserID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func getUser(txn *badger.Txn, id string) (*User, error) {
+	item, err := txn.Get(userKey(id))
+	if err == badger.ErrKeyNotFound {
+		return nil, &NoSuchUser{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	user := &User{}
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, user)
+	})
+	return user, err
+}
+
+func getUserByEncodedIdentifier(txn *badger.Txn, encoded string) (*User, error) {
+	item, err := txn.Get(encodedUserIndexKey(encoded))
+	if err == badger.ErrKeyNotFound {
+		return nil, &NoSuchUser{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	id := ""
+	err = item.Value(func(v []byte) error {
+		id = string(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getUser(txn, id)
+}
+
+func getUserByIdentifier(txn *badger.Txn, identifier string) (*User, error) {
+	return getUserByEncodedIdentifier(txn, EncodeIdentifier(identifier))
+}
+
+func setUser(txn *badger.Txn, user *User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	err = txn.Set(userKey(user.ID), data)
+	if err != nil {
+		return err
+	}
+	return txn.Set(userIndexKey(user.Identifier), []byte(user.ID))
+}
+
+func (s *State) UserByID(id string) (*User, error) {
+	var user *User
+	err := s.view("UserByID", func(txn *badger.Txn) error {
+		u, err := getUser(txn, id)
+		user = u
+		return err
+	})
+	return user, err
+}
+
+func (s *State) UserByIdentifier(identifier string) (*User, error) {
+	var user *User
+	err := s.view("UserByIdentifier", func(txn *badger.Txn) error {
+		u, err := getUserByIdentifier(txn, identifier)
+		user = u
+		return err
+	})
+	return user, err
+}
+
+func (s *State) updateOrCreateUser(identifier string, update func(user *User)) (*User, error) {
+	var user *User
+	err := s.update("updateOrCreateUser", func(txn *badger.Txn) error {
+		u, err := getUserByIdentifier(txn, identifier)
+		if _, ok := err.(*NoSuchUser); ok {
+			id, err := newUserID()
+			if err != nil {
+				return err
+			}
+			u = &User{
+				ID:         id,
+				Identifier: identifier,
+				CreatedAt:  time.Now().Unix(),
+			}
+		} else if err != nil {
+			return err
+		}
+		update(u)
+		user = u
+		return setUser(txn, u)
+	})
+	return user, err
+}
+
+// RecordLogin updates LastLoginAt and creates the user if necessary
+func (s *State) RecordLogin(identifier string) (*User, error) {
+	return s.updateOrCreateUser(identifier, func(user *User) {
+		user.LastLoginAt = time.Now().Unix()
+	})
+}
+
+// EnsureUser returns the user of the identifier, creating it if necessary
+func (s *State) EnsureUser(identifier string) (*User, error) {
+	return s.updateOrCreateUser(identifier, func(user *User) {})
+}
+
+// UpdateUser stores the profile fields of user (DisplayName, Roles and
+// Attributes), the other fields cannot be changed
+func (s *State) UpdateUser(user User) (*User, error) {
+	var updated *User
+	err := s.update("UpdateUser", func(txn *badger.Txn) error {
+		u, err := getUser(txn, user.ID)
+		if err != nil {
+			return err
+		}
+		u.DisplayName = user.DisplayName
+		u.Roles = user.Roles
+		u.Attributes = user.Attributes
+		updated = u
+		return setUser(txn, u)
+	})
+	return updated, err
+}
+
+func (s *State) AllUsers() ([]User, error) {
+	users := []User{}
+	err := s.view("AllUsers", func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(userKeyPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				user := User{}
+				err := json.Unmarshal(v, &user)
+				if err != nil {
+					return err
+				}
+				users = append(users, user)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return users, err
+}
+
+// RevokeSessions rejects all refresh tokens issued to the identifier so far,
+// access tokens stay valid until they expire
+func (s *State) RevokeSessions(identifier string) (*User, error) {
+	var user *User
+	err := s.update("RevokeSessions", func(txn *badger.Txn) error {
+		u, err := getUserByIdentifier(txn, identifier)
+		if err != nil {
+			return err
+		}
+		u.SessionsRevokedAt = time.Now().Unix()
+		u.SessionGeneration++
+		user = u
+		return setUser(txn, u)
+	})
+	return user, err
+}
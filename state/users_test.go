@@ -0,0 +1,122 @@
+package state
+
+import (
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+func TestRecordLogin(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := State{
+		DB: db,
+	}
+	_, err = state.UserByIdentifier("foo@bar.com")
+	if _, ok := err.(*NoSuchUser); !ok {
+		t.Fatalf("Expected NoSuchUser, got %v", err)
+	}
+	user, err := state.RecordLogin("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.ID) == 0 || user.CreatedAt == 0 || user.LastLoginAt == 0 {
+		t.Fatalf("Expected a complete user, got %+v", user)
+	}
+	again, err := state.RecordLogin("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != user.ID || again.CreatedAt != user.CreatedAt {
+		t.Fatal("Expected the user to be stable across logins")
+	}
+	other, err := state.RecordLogin("foo@baz.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == user.ID {
+		t.Fatal("Expected a different id for a different identifier")
+	}
+	users, err := state.AllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("Expected exactly two users, got %d", len(users))
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := State{
+		DB: db,
+	}
+	user, err := state.EnsureUser("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.LastLoginAt != 0 {
+		t.Fatal("Expected EnsureUser not to record a login")
+	}
+	_, err = state.UpdateUser(User{
+		ID:          user.ID,
+		Identifier:  "evil@bar.com",
+		DisplayName: "Foo",
+		Roles:       []string{"admin"},
+		Attributes:  map[string]string{"department": "ops"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := state.UserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Identifier != "foo@bar.com" {
+		t.Fatal("Expected the identifier to be immutable")
+	}
+	if updated.DisplayName != "Foo" || len(updated.Roles) != 1 || updated.Attributes["department"] != "ops" {
+		t.Fatalf("Expected the profile to be updated, got %+v", updated)
+	}
+	_, err = state.UpdateUser(User{ID: "doesnotexist"})
+	if _, ok := err.(*NoSuchUser); !ok {
+		t.Fatalf("Expected NoSuchUser, got %v", err)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := State{
+		DB: db,
+	}
+	_, err = state.RevokeSessions("foo@bar.com")
+	if _, ok := err.(*NoSuchUser); !ok {
+		t.Fatalf("Expected NoSuchUser, got %v", err)
+	}
+	_, err = state.RecordLogin("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := state.RevokeSessions("foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := state.UserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SessionsRevokedAt == 0 {
+		t.Error("Expected SessionsRevokedAt to be set")
+	}
+	if stored.SessionGeneration != 1 {
+		t.Errorf("Expected session generation 1, got %d", stored.SessionGeneration)
+	}
+}
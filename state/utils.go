@@ -4,7 +4,7 @@ import badger "github.com/dgraph-io/badger/v3"
 
 func (s *State) AllKeys() ([][]byte, error) {
 	keys := [][]byte{}
-	err := s.DB.View(func(txn *badger.Txn) error {
+	err := s.view("AllKeys", func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
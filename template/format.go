@@ -0,0 +1,44 @@
+package template
+
+import (
+	"text/template"
+	"time"
+)
+
+type dateLayouts struct {
+	date string
+	time string
+}
+
+var localeDateLayouts = map[string]dateLayouts{
+	"en": {date: "Jan 2, 2006", time: "3:04 PM MST"},
+	"de": {date: "02.01.2006", time: "15:04 MST"},
+	"fr": {date: "02/01/2006", time: "15:04 MST"},
+}
+
+func layoutsForLanguage(lang string) dateLayouts {
+	if layouts, ok := localeDateLayouts[lang]; ok {
+		return layouts
+	}
+	if base, ok := MatchLanguage([]string{"en", "de", "fr"}, lang); ok {
+		return localeDateLayouts[base]
+	}
+	return dateLayouts{date: "2006-01-02", time: "15:04 MST"}
+}
+
+// templateFuncs returns the helper functions for templates of lang:
+// formatDate, formatTime and formatDateTime
+func templateFuncs(lang string) template.FuncMap {
+	layouts := layoutsForLanguage(lang)
+	return template.FuncMap{
+		"formatDate": func(t time.Time) string {
+			return t.Format(layouts.date)
+		},
+		"formatTime": func(t time.Time) string {
+			return t.Format(layouts.time)
+		},
+		"formatDateTime": func(t time.Time) string {
+			return t.Format(layouts.date + " " + layouts.time)
+		},
+	}
+}
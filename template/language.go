@@ -0,0 +1,108 @@
+package template
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Languages returns all languages that have at least one template
+func (s *Store) Languages() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	seen := map[string]bool{}
+	languages := []string{}
+	for key := range s.templates {
+		lang, _ := splitKey(key)
+		if !seen[lang] {
+			seen[lang] = true
+			languages = append(languages, lang)
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+func (s *Store) HasLanguage(lang string) bool {
+	for _, available := range s.Languages() {
+		if available == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchLanguage returns the available language for a tag like `de-AT`,
+// either an exact (case insensitive) match or its base language `de`
+func MatchLanguage(available []string, tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(strings.ReplaceAll(tag, "_", "-")))
+	if len(tag) == 0 {
+		return "", false
+	}
+	base := strings.SplitN(tag, "-", 2)[0]
+	for _, lang := range available {
+		if strings.ToLower(lang) == tag {
+			return lang, true
+		}
+	}
+	for _, lang := range available {
+		if strings.ToLower(lang) == base {
+			return lang, true
+		}
+	}
+	return "", false
+}
+
+type weightedTag struct {
+	tag    string
+	weight float64
+}
+
+// ParseAcceptLanguage returns the tags of an Accept-Language header ordered
+// by their quality value, tags with q=0 and `*` are omitted
+func ParseAcceptLanguage(header string) []string {
+	weighted := []weightedTag{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if len(tag) == 0 || tag == "*" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					weight = q
+				}
+			}
+		}
+		if weight <= 0 {
+			continue
+		}
+		weighted = append(weighted, weightedTag{tag: tag, weight: weight})
+	}
+	sort.SliceStable(weighted, func(i, j int) bool {
+		return weighted[i].weight > weighted[j].weight
+	})
+	tags := []string{}
+	for _, w := range weighted {
+		tags = append(tags, w.tag)
+	}
+	return tags
+}
+
+// NegotiateLanguage picks the first available language from the candidates
+// in order, each candidate is either a language tag or an Accept-Language
+// header
+func NegotiateLanguage(available []string, candidates ...string) (string, bool) {
+	for _, candidate := range candidates {
+		for _, tag := range ParseAcceptLanguage(candidate) {
+			if lang, ok := MatchLanguage(available, tag); ok {
+				return lang, true
+			}
+		}
+	}
+	return "", false
+}
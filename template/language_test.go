@@ -0,0 +1,44 @@
+package template
+
+import "testing"
+
+func TestNegotiateLanguage(t *testing.T) {
+	available := []string{"de", "en", "fr", "pt-BR"}
+	testSet := []struct {
+		candidates []string
+		expected   string
+		ok         bool
+	}{
+		{candidates: []string{"de"}, expected: "de", ok: true},
+		{candidates: []string{"de-AT"}, expected: "de", ok: true},
+		{candidates: []string{"pt_br"}, expected: "pt-BR", ok: true},
+		{candidates: []string{"", "fr-CH, fr;q=0.9, en;q=0.8"}, expected: "fr", ok: true},
+		{candidates: []string{"", "nl, en;q=0.5, de;q=0.7"}, expected: "de", ok: true},
+		{candidates: []string{"es", "nl, de;q=0"}, expected: "", ok: false},
+		{candidates: []string{"", "*"}, expected: "", ok: false},
+		{candidates: []string{"it", "", "en"}, expected: "en", ok: true},
+	}
+	for _, test := range testSet {
+		lang, ok := NegotiateLanguage(available, test.candidates...)
+		if ok != test.ok || lang != test.expected {
+			t.Errorf("Expected %s (%t) for %v but got %s (%t)", test.expected, test.ok, test.candidates, lang, ok)
+		}
+	}
+}
+
+func TestStoreLanguages(t *testing.T) {
+	store, err := NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	languages := store.Languages()
+	expected := []string{"de", "en", "fr"}
+	if len(languages) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, languages)
+	}
+	for i := range expected {
+		if languages[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, languages)
+		}
+	}
+}
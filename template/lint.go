@@ -0,0 +1,110 @@
+package template
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Problem struct {
+	Lang    string `json:"lang"`
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", templateKey(p.Lang, p.ID), p.Message)
+}
+
+type Rendered struct {
+	Lang   string `json:"lang"`
+	ID     string `json:"id"`
+	Output string `json:"output"`
+}
+
+// Unlikely to show up in a template by accident
+const lintToken = "LINT-TOKEN-7Q2X"
+
+// Templates with these prefixes are not sent along with a token
+var tokenlessPrefixes = []string{"invitation"}
+
+func requiresToken(id string) bool {
+	for _, prefix := range tokenlessPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Render evaluates all templates found in path (see NewStore) that match
+// lang and id with SampleData, empty filters match everything.
+// Besides parse and execution errors it reports login templates that do
+// not contain the token and ids that are missing for a language but exist
+// for another one.
+func Render(path string, lang string, id string) ([]Rendered, []Problem, error) {
+	templates, err := readAllTemplates(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := []string{}
+	languages := map[string]bool{}
+	ids := map[string]bool{}
+	for key := range templates {
+		keys = append(keys, key)
+		l, i := splitKey(key)
+		languages[l] = true
+		ids[i] = true
+	}
+	sort.Strings(keys)
+	data := SampleData()
+	data.Token = lintToken
+	data.LoginURL = ""
+	rendered := []Rendered{}
+	problems := []Problem{}
+	for _, key := range keys {
+		l, i := splitKey(key)
+		if (len(lang) > 0 && l != lang) || (len(id) > 0 && i != id) {
+			continue
+		}
+		output, err := evaluate(l, i, templates[key], data)
+		if err != nil {
+			problems = append(problems, Problem{Lang: l, ID: i, Message: err.Error()})
+			continue
+		}
+		if requiresToken(i) && !strings.Contains(output, lintToken) {
+			problems = append(problems, Problem{Lang: l, ID: i, Message: "does not reference {{.Token}}"})
+		}
+		rendered = append(rendered, Rendered{
+			Lang:   l,
+			ID:     i,
+			Output: strings.ReplaceAll(output, lintToken, SampleData().Token),
+		})
+	}
+	for _, l := range sortedKeys(languages) {
+		if len(lang) > 0 && l != lang {
+			continue
+		}
+		for _, i := range sortedKeys(ids) {
+			if len(id) > 0 && i != id {
+				continue
+			}
+			if _, ok := templates[templateKey(l, i)]; !ok {
+				problems = append(problems, Problem{Lang: l, ID: i, Message: "missing"})
+			}
+		}
+	}
+	if len(rendered) == 0 && len(problems) == 0 {
+		problems = append(problems, Problem{Lang: lang, ID: id, Message: "no such template"})
+	}
+	return rendered, problems, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
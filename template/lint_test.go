@@ -0,0 +1,51 @@
+package template
+
+import "testing"
+
+func TestRenderBuiltIn(t *testing.T) {
+	rendered, problems, err := Render("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Expected the built in templates to be valid: %v", problems)
+	}
+	if len(rendered) != 21 {
+		t.Fatalf("Expected 21 templates, got %d", len(rendered))
+	}
+	rendered, _, err = Render("", "de", "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rendered) != 1 || rendered[0].Lang != "de" || rendered[0].ID != "email" {
+		t.Fatalf("Expected only de:email, got %v", rendered)
+	}
+}
+
+func TestRenderProblems(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "it", "email", "Ciao {{.Service}}")
+	writeTemplate(t, dir, "it", "sms", "{{.Token}")
+	writeTemplate(t, dir, "it", "email-subject", "{{.Missing}} {{.Token}}")
+	_, problems, err := Render(dir, "it", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{
+		"it:email":              true,
+		"it:sms":                true,
+		"it:email-subject":      true,
+		"it:email-html":         true,
+		"it:invitation":         true,
+		"it:invitation-subject": true,
+		"it:invitation-sms":     true,
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v", len(expected), problems)
+	}
+	for _, problem := range problems {
+		if !expected[templateKey(problem.Lang, problem.ID)] {
+			t.Errorf("Unexpected problem %s", problem)
+		}
+	}
+}
@@ -1,46 +1,300 @@
 package template
 
 import (
-	"errors"
+	"embed"
 	"fmt"
+	htmlTemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 type TemplateData struct {
 	Service string
 	Token   string
 	IP      string
+	// Language of the template
+	Lang string
+	// When the token was requested and when it expires, use
+	// formatDate, formatTime or formatDateTime to format them
+	RequestTime time.Time
+	ExpiresAt   time.Time
+	// Lifetime of the token in minutes, rounded up
+	ExpiresInMinutes uint64
+	UserAgent        UserAgent
+	// Optional, might be empty
+	SupportURL string
+	// Optional link that logs in without entering the token
+	LoginURL string
 }
 
-var templates = map[string]string{
-	"en:email": `Hi,
+// SampleData is used to validate templates
+func SampleData() TemplateData {
+	requestTime := time.Date(2021, 7, 1, 14, 22, 0, 0, time.UTC)
+	return TemplateData{
+		Service:          "Passwordless",
+		Token:            "12345678",
+		IP:               "192.0.2.1",
+		Lang:             "en",
+		RequestTime:      requestTime,
+		ExpiresAt:        requestTime.Add(10 * time.Minute),
+		ExpiresInMinutes: 10,
+		UserAgent:        ParseUserAgent("Mozilla/5.0 (X11; Linux x86_64; rv:90.0) Gecko/20100101 Firefox/90.0"),
+		SupportURL:       "https://example.com/support",
+		LoginURL:         "https://example.com/login?identifier=alice%40example.com&token=12345678",
+	}
+}
 
-your login Token is "{{.Token}}".
+// The built in templates, laid out as <lang>/<id>.tmpl
+//
+//go:embed defaults
+var defaults embed.FS
 
-Login IP: {{.IP}}
+type NoSuchTemplate struct {
+	Key string
+}
 
-Thanks,
+func (e *NoSuchTemplate) Error() string {
+	return fmt.Sprintf("NoSuchTemplate: %s", e.Key)
+}
 
-{{.Service}}
-`,
-	"en:email-subject": "[{{.Service}}] - {{.Token}} is your login token.",
+// Templates whose id ends with this suffix are HTML and escaped accordingly
+const HTMLSuffix = "-html"
+
+func templateKey(lang string, id string) string {
+	return fmt.Sprintf("%s:%s", lang, id)
 }
 
-func EvaluateTemplate(lang string, id string, data TemplateData) (string, error) {
-	key := fmt.Sprintf("%s:%s", lang, id)
-	textTemplate, ok := templates[key]
-	if !ok {
-		return "", errors.New("No such template")
+// readTemplates reads all <lang>/<id>.tmpl files of fsys
+func readTemplates(fsys fs.FS) (map[string]string, error) {
+	templates := map[string]string{}
+	paths, err := fs.Glob(fsys, "*/*.tmpl")
+	if err != nil {
+		return nil, err
 	}
-	parsedTemplate, err := template.New(key).Parse(textTemplate)
+	for _, p := range paths {
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		lang := path.Dir(p)
+		id := strings.TrimSuffix(path.Base(p), ".tmpl")
+		templates[templateKey(lang, id)] = string(data)
+	}
+	return templates, nil
+}
+
+func evaluate(lang string, id string, textTemplate string, data TemplateData) (string, error) {
+	key := templateKey(lang, id)
+	data.Lang = lang
+	funcs := templateFuncs(lang)
+	sBuilder := &strings.Builder{}
+	if strings.HasSuffix(id, HTMLSuffix) {
+		parsedTemplate, err := htmlTemplate.New(key).Funcs(htmlTemplate.FuncMap(funcs)).Option("missingkey=error").Parse(textTemplate)
+		if err != nil {
+			return "", err
+		}
+		err = parsedTemplate.Execute(sBuilder, data)
+		if err != nil {
+			return "", err
+		}
+		return sBuilder.String(), nil
+	}
+	parsedTemplate, err := template.New(key).Funcs(funcs).Option("missingkey=error").Parse(textTemplate)
 	if err != nil {
 		return "", err
 	}
-	sBuilder := &strings.Builder{}
 	err = parsedTemplate.Execute(sBuilder, data)
 	if err != nil {
 		return "", err
 	}
 	return sBuilder.String(), nil
 }
+
+// Store holds the built in templates overlaid with the templates found in
+// an optional directory
+type Store struct {
+	mutex     sync.RWMutex
+	path      string
+	templates map[string]string
+	modTime   time.Time
+}
+
+// NewStore loads and validates all templates, path may be empty
+func NewStore(path string) (*Store, error) {
+	store := &Store{
+		path: path,
+	}
+	err := store.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// readAllTemplates returns the built in templates overlaid with the
+// templates in path without validating them
+func readAllTemplates(path string) (map[string]string, error) {
+	sub, err := fs.Sub(defaults, "defaults")
+	if err != nil {
+		return nil, err
+	}
+	templates, err := readTemplates(sub)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) > 0 {
+		overrides, err := readTemplates(os.DirFS(path))
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range overrides {
+			templates[key] = value
+		}
+	}
+	return templates, nil
+}
+
+func splitKey(key string) (string, string) {
+	parts := strings.SplitN(key, ":", 2)
+	return parts[0], parts[1]
+}
+
+func (s *Store) load() (map[string]string, error) {
+	templates, err := readAllTemplates(s.path)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range templates {
+		lang, id := splitKey(key)
+		_, err := evaluate(lang, id, value, SampleData())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template %s: %v", key, err)
+		}
+	}
+	return templates, nil
+}
+
+// Reload reads all templates again, the current templates are kept if
+// any of the new templates is invalid
+func (s *Store) Reload() error {
+	modTime, err := s.lastModified()
+	if err != nil {
+		return err
+	}
+	templates, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.templates = templates
+	s.modTime = modTime
+	return nil
+}
+
+func (s *Store) lastModified() (time.Time, error) {
+	latest := time.Time{}
+	if len(s.path) == 0 {
+		return latest, nil
+	}
+	err := filepath.Walk(s.path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest, err
+}
+
+// Watch reloads the templates whenever a file in the directory changes,
+// it blocks until stop is closed
+func (s *Store) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			modTime, err := s.lastModified()
+			if err != nil {
+				log.Warn().Str("module", "template").Msgf("Could not check templates: %v", err)
+				continue
+			}
+			s.mutex.RLock()
+			changed := !modTime.Equal(s.modTime)
+			s.mutex.RUnlock()
+			if !changed {
+				continue
+			}
+			err = s.Reload()
+			if err != nil {
+				log.Error().Str("module", "template").Msgf("Keeping previous templates: %v", err)
+				continue
+			}
+			log.Info().Str("module", "template").Msg("Reloaded templates")
+		}
+	}
+}
+
+// Keys returns all `<lang>:<id>` keys in order
+func (s *Store) Keys() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	keys := []string{}
+	for key := range s.templates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Store) Has(lang string, id string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.templates[templateKey(lang, id)]
+	return ok
+}
+
+func (s *Store) Evaluate(lang string, id string, data TemplateData) (string, error) {
+	key := templateKey(lang, id)
+	s.mutex.RLock()
+	textTemplate, ok := s.templates[key]
+	s.mutex.RUnlock()
+	if !ok {
+		return "", &NoSuchTemplate{Key: key}
+	}
+	return evaluate(lang, id, textTemplate, data)
+}
+
+func mustNewDefaultStore() *Store {
+	store, err := NewStore("")
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+// DefaultStore is used by EvaluateTemplate, it only contains the built in
+// templates until SetDefaultStore is called
+var DefaultStore = mustNewDefaultStore()
+
+func SetDefaultStore(store *Store) {
+	DefaultStore = store
+}
+
+func EvaluateTemplate(lang string, id string, data TemplateData) (string, error) {
+	return DefaultStore.Evaluate(lang, id, data)
+}
@@ -1,6 +1,9 @@
 package template
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -46,3 +49,165 @@ func TestEmailEnglishSubject(t *testing.T) {
 		t.Fatal("Expected result to be non-empty")
 	}
 }
+
+func TestSMSEnglish(t *testing.T) {
+	result, err := EvaluateTemplate("en", "sms", testData)
+	if err != nil {
+		t.Fatalf("Expected err to be nil: %v", err)
+	}
+	if !strings.Contains(result, "abcd") {
+		t.Fatal("Expected the result to contain `abcd`")
+	}
+	if len(result) > 160 {
+		t.Fatal("Expected the result to fit into a single SMS")
+	}
+}
+
+func writeTemplate(t *testing.T, dir string, lang string, id string, content string) {
+	err := os.MkdirAll(filepath.Join(dir, lang), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, lang, id+".tmpl"), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreOverrides(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "en", "email-subject", "Login to {{.Service}}")
+	writeTemplate(t, dir, "de", "email", "Dein Token: {{.Token}}")
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := store.Evaluate("en", "email-subject", testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Login to TestService" {
+		t.Fatalf("Expected the override to be used, got %s", result)
+	}
+	result, err = store.Evaluate("en", "email", testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result, "abcd") {
+		t.Fatal("Expected the built in template to be used")
+	}
+	result, err = store.Evaluate("de", "email", testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Dein Token: abcd" {
+		t.Fatalf("Expected the new language to be used, got %s", result)
+	}
+}
+
+func TestStoreRejectsInvalidTemplates(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "en", "email", "{{.Token}")
+	_, err := NewStore(dir)
+	if err == nil {
+		t.Fatal("Expected a parse error")
+	}
+	writeTemplate(t, dir, "en", "email", "{{.DoesNotExist}}")
+	_, err = NewStore(dir)
+	if err == nil {
+		t.Fatal("Expected an error for an unknown field")
+	}
+}
+
+func TestStoreReloadKeepsValidTemplates(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "en", "sms", "v1 {{.Token}}")
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTemplate(t, dir, "en", "sms", "v2 {{.Token}")
+	err = store.Reload()
+	if err == nil {
+		t.Fatal("Expected the reload to fail")
+	}
+	result, err := store.Evaluate("en", "sms", testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "v1 abcd" {
+		t.Fatalf("Expected the previous template, got %s", result)
+	}
+	writeTemplate(t, dir, "en", "sms", "v2 {{.Token}}")
+	err = store.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = store.Evaluate("en", "sms", testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "v2 abcd" {
+		t.Fatalf("Expected the new template, got %s", result)
+	}
+}
+
+func TestHTMLEscaping(t *testing.T) {
+	data := testData
+	data.Service = "<script>"
+	result, err := EvaluateTemplate("en", "email-html", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(result, "<script>") {
+		t.Fatal("Expected the HTML template to escape its data")
+	}
+}
+
+func TestFormatHelpers(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "en", "sms", "{{formatDate .ExpiresAt}} {{formatTime .ExpiresAt}}")
+	writeTemplate(t, dir, "de", "sms", "{{formatDateTime .ExpiresAt}}")
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := SampleData()
+	result, err := store.Evaluate("en", "sms", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Jul 1, 2021 2:32 PM UTC" {
+		t.Errorf("Unexpected english date: %s", result)
+	}
+	result, err = store.Evaluate("de", "sms", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "01.07.2021 14:32 UTC" {
+		t.Errorf("Unexpected german date: %s", result)
+	}
+}
+
+func TestOptionalFields(t *testing.T) {
+	data := SampleData()
+	result, err := EvaluateTemplate("en", "email", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result, data.LoginURL) || !strings.Contains(result, data.SupportURL) {
+		t.Fatal("Expected the result to contain the login and support URL")
+	}
+	if !strings.Contains(result, "Firefox on Linux") {
+		t.Fatal("Expected the result to contain the user agent")
+	}
+	data.LoginURL = ""
+	data.SupportURL = ""
+	result, err = EvaluateTemplate("en", "email", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(result, "link") || strings.Contains(result, "Questions") {
+		t.Fatalf("Expected the optional parts to be omitted: %s", result)
+	}
+}
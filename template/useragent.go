@@ -0,0 +1,77 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+)
+
+type UserAgent struct {
+	// The header as sent by the client, never render this in messages
+	Raw     string
+	Browser string
+	OS      string
+}
+
+// Order matters, e.g. every Chrome UA also contains `Safari`
+var browserTokens = []struct {
+	token string
+	name  string
+}{
+	{token: "Edg/", name: "Edge"},
+	{token: "OPR/", name: "Opera"},
+	{token: "Firefox/", name: "Firefox"},
+	{token: "Chromium/", name: "Chromium"},
+	{token: "Chrome/", name: "Chrome"},
+	{token: "CriOS/", name: "Chrome"},
+	{token: "FxiOS/", name: "Firefox"},
+	{token: "Safari/", name: "Safari"},
+	{token: "curl/", name: "curl"},
+}
+
+var osTokens = []struct {
+	token string
+	name  string
+}{
+	{token: "Android", name: "Android"},
+	{token: "iPhone", name: "iOS"},
+	{token: "iPad", name: "iPadOS"},
+	{token: "CrOS", name: "ChromeOS"},
+	{token: "Windows", name: "Windows"},
+	{token: "Mac OS X", name: "macOS"},
+	{token: "Macintosh", name: "macOS"},
+	{token: "Linux", name: "Linux"},
+}
+
+// ParseUserAgent detects the common browsers and operating systems, it is
+// only meant to give recipients a hint where a login was requested from
+func ParseUserAgent(raw string) UserAgent {
+	userAgent := UserAgent{Raw: raw}
+	for _, browser := range browserTokens {
+		if strings.Contains(raw, browser.token) {
+			userAgent.Browser = browser.name
+			break
+		}
+	}
+	for _, os := range osTokens {
+		if strings.Contains(raw, os.token) {
+			userAgent.OS = os.name
+			break
+		}
+	}
+	return userAgent
+}
+
+// String returns e.g. `Firefox on Linux`. Unknown agents are not echoed,
+// the header is chosen by whoever requests the login and would end up in
+// a signed message to the owner of the identifier.
+func (u UserAgent) String() string {
+	switch {
+	case len(u.Browser) > 0 && len(u.OS) > 0:
+		return fmt.Sprintf("%s on %s", u.Browser, u.OS)
+	case len(u.Browser) > 0:
+		return u.Browser
+	case len(u.OS) > 0:
+		return u.OS
+	}
+	return "unknown"
+}
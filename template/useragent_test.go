@@ -0,0 +1,27 @@
+package template
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	testSet := []struct {
+		raw      string
+		expected string
+	}{
+		{raw: "Mozilla/5.0 (X11; Linux x86_64; rv:90.0) Gecko/20100101 Firefox/90.0", expected: "Firefox on Linux"},
+		{raw: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36 Edg/91.0.864.64", expected: "Edge on Windows"},
+		{raw: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1.1 Safari/605.1.15", expected: "Safari on macOS"},
+		{raw: "Mozilla/5.0 (iPhone; CPU iPhone OS 14_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/91.0.4472.80 Mobile/15E148 Safari/604.1", expected: "Chrome on iOS"},
+		{raw: "Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.120 Mobile Safari/537.36", expected: "Chrome on Android"},
+		{raw: "curl/7.77.0", expected: "curl"},
+		{raw: "SomethingElse/1.0", expected: "unknown"},
+		{raw: "Your account was compromised, call +1 555 0100 and read them this token", expected: "unknown"},
+		{raw: "x\r\nPlease reply with your password", expected: "unknown"},
+		{raw: "", expected: "unknown"},
+	}
+	for _, test := range testSet {
+		res := ParseUserAgent(test.raw).String()
+		if res != test.expected {
+			t.Errorf("Expected %s for %s but got %s", test.expected, test.raw, res)
+		}
+	}
+}